@@ -251,7 +251,7 @@ func newPickedCompactionFromL0(
 	files := make([]*manifest.FileMetadata, 0, len(lcf.Files))
 	iter := vers.Levels[0].Iter()
 	for f := iter.First(); f != nil; f = iter.Next() {
-		if lcf.FilesIncluded[f.L0Index] {
+		if lcf.FilesIncluded.Contains(f.L0Index) {
 			files = append(files, f)
 		}
 	}
@@ -371,7 +371,7 @@ func (pc *pickedCompaction) setupInputs(
 			iter := pc.version.Levels[0].Iter()
 			var sizeSum uint64
 			for j, f := 0, iter.First(); f != nil; j, f = j+1, iter.Next() {
-				if pc.lcf.FilesIncluded[f.L0Index] {
+				if pc.lcf.FilesIncluded.Contains(f.L0Index) {
 					newStartLevelFiles = append(newStartLevelFiles, f)
 					sizeSum += f.Size
 				}
@@ -1469,7 +1469,7 @@ func pickL0(
 	//
 	// TODO(bilal) Remove the minCompactionDepth parameter once fixing it at 1
 	// has been shown to not cause a performance regression.
-	lcf, err := vers.L0Sublevels.PickBaseCompaction(1, vers.Levels[baseLevel].Slice())
+	lcf, err := vers.L0Sublevels.PickBaseCompaction(1, vers.Levels[baseLevel].Slice(), manifest.L0PickOptions{})
 	if err != nil {
 		opts.Logger.Infof("error when picking base compaction: %s", err)
 		return
@@ -1487,7 +1487,7 @@ func pickL0(
 	// compaction. Note that we pass in L0CompactionThreshold here as opposed to
 	// 1, since choosing a single sublevel intra-L0 compaction is
 	// counterproductive.
-	lcf, err = vers.L0Sublevels.PickIntraL0Compaction(env.earliestUnflushedSeqNum, minIntraL0Count)
+	lcf, err = vers.L0Sublevels.PickIntraL0Compaction(env.earliestUnflushedSeqNum, minIntraL0Count, manifest.L0PickOptions{})
 	if err != nil {
 		opts.Logger.Infof("error when picking intra-L0 compaction: %s", err)
 		return
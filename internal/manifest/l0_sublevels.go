@@ -6,8 +6,11 @@ package manifest
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"math"
+	"math/bits"
 	"sort"
 	"strings"
 
@@ -189,27 +192,86 @@ type fileInterval struct {
 	estimatedBytes uint64
 }
 
-// Helper type for any cases requiring a bool slice.
-type bitSet []bool
+// mostlyCreatedBefore returns true if the majority of the non-compacting files
+// in the interval were created before the specified time.
+func (interval *fileInterval) mostlyCreatedBefore(createdBefore int64) bool {
+	older, total := 0, 0
+	for _, f := range interval.files {
+		if f == nil || f.IsCompacting() {
+			continue
+		}
+		total++
+		if f.CreationTime < createdBefore {
+			older++
+		}
+	}
+	return 2*older > total
+}
+
+// centeredFileCount returns the number of non-compacting files in the interval
+// whose interval bounds are both within radius intervals of it.
+func (interval *fileInterval) centeredFileCount(radius int) int {
+	count := 0
+	for _, f := range interval.files {
+		if f == nil || f.IsCompacting() {
+			continue
+		}
+		if interval.index-f.minIntervalIndex <= radius && f.maxIntervalIndex-interval.index <= radius {
+			count++
+		}
+	}
+	return count
+}
+
+// bitSet is a set of small non-negative integers, such as the L0Index of files
+// or the indices of intervals, packed into 64-bit words.
+type bitSet []uint64
 
+// newBitSet returns an empty bitSet holding integers in [0, n).
 func newBitSet(n int) bitSet {
-	return make([]bool, n)
+	return make(bitSet, (n+63)/64)
+}
+
+// Contains returns true if i is in the set.
+func (b bitSet) Contains(i int) bool {
+	return b[i/64]&(1<<(uint(i)%64)) != 0
 }
 
 func (b *bitSet) markBit(i int) {
-	(*b)[i] = true
+	(*b)[i/64] |= 1 << (uint(i) % 64)
 }
 
 func (b *bitSet) markBits(start, end int) {
 	for i := start; i < end; i++ {
-		(*b)[i] = true
+		b.markBit(i)
 	}
 }
 
 func (b *bitSet) clearAllBits() {
 	for i := range *b {
-		(*b)[i] = false
+		(*b)[i] = 0
+	}
+}
+
+// reset empties the set and resizes it to hold integers in [0, n), reusing its
+// storage if large enough.
+func (b *bitSet) reset(n int) {
+	words := (n + 63) / 64
+	if cap(*b) < words {
+		*b = newBitSet(n)
+		return
+	}
+	*b = (*b)[:words]
+	b.clearAllBits()
+}
+
+// count returns the number of integers in the set.
+func (b bitSet) count() int {
+	n := 0
+	for _, w := range b {
+		n += bits.OnesCount64(w)
 	}
+	return n
 }
 
 // L0Compaction describes an active compaction with inputs from L0.
@@ -249,11 +311,196 @@ type L0Sublevels struct {
 
 	// Keys to break flushes at.
 	flushSplitUserKeys [][]byte
+	// flushSplitIntervals holds the index of the interval each flush split
+	// key was placed at.
+	flushSplitIntervals []int
+	// flushSplitBytes holds, for each flush split key, the estimated bytes
+	// accumulated since the previous split key, or since the first interval.
+	flushSplitBytes []uint64
+	// flushSplitMaxBytes and flushSplitThresholdBytes are the arguments the
+	// flush split keys were computed with, see flushSplitThreshold.
+	flushSplitMaxBytes       int64
+	flushSplitThresholdBytes uint64
+	// flushSplitFingerprint is the fingerprint of the files that
+	// flushSplitUserKeys were computed from, see FlushSplitsAreStale.
+	flushSplitFingerprint uint64
+
+	opts L0SublevelsOptions
+
+	// generation is incremented whenever the compacting state of L0 is
+	// updated, and is used to invalidate basePickCache.
+	generation uint64
+	// basePickCache holds the result of the last PickBaseCompaction call, if
+	// opts.CacheBasePicks is true.
+	basePickCache *basePickCacheEntry
+	// compactingFiles and compactingBaseBounds are the compacting files and
+	// in-progress base compactions that InitCompactingFileInfo last
+	// initialized the compacting state from, at generation
+	// compactingGeneration, see compactingStateUnchanged. The user keys of the
+	// bounds are copied, back to back, into compactingBaseKeys, and the bounds
+	// are sorted, so that the order of the in-progress compactions doesn't
+	// matter. compactingBaseMatched is scratch space for
+	// compactingStateUnchanged. They are only meaningful if
+	// compactingInitialized is true.
+	compactingFiles       []int
+	compactingBaseBounds  []compactingBounds
+	compactingBaseKeys    []byte
+	compactingBaseMatched bitSet
+	compactingGeneration  uint64
+	compactingInitialized bool
 
 	// Only used to check invariants.
 	addL0FilesCalled bool
 }
 
+// L0SublevelsOptions configures the construction of L0Sublevels. The zero
+// value constructs L0Sublevels with the default behavior.
+type L0SublevelsOptions struct {
+	// FileIntervalBytes, if non-nil, overrides the estimate of how a file's
+	// bytes are distributed across the intervals it overlaps. By default, a
+	// file's bytes are assumed to be spread uniformly across its intervals.
+	// FileIntervalBytes is called with a file overlapping n intervals, and the
+	// n+1 user keys bounding those intervals: interval i spans [bounds[i],
+	// bounds[i+1]). bounds[0] is the file's smallest user key and bounds[n]
+	// is the file's largest user key. It must return a slice of n byte
+	// estimates, one per interval. These estimates feed flush split key
+	// placement.
+	FileIntervalBytes func(f *FileMetadata, bounds [][]byte) []uint64
+
+	// EstimateIntervalBytes, if non-nil, estimates the bytes of the file f
+	// within the interval [start, end), such as with
+	// sstable.Reader.EstimateDiskUsage. It is called once for every interval
+	// f overlaps, and is an alternative to FileIntervalBytes for estimators
+	// that work one key span at a time. For the last interval f overlaps, end
+	// is f's largest user key. At most one of FileIntervalBytes and
+	// EstimateIntervalBytes may be set.
+	EstimateIntervalBytes func(f *FileMetadata, start, end []byte) uint64
+
+	// KeySpaceWidth, if non-nil, returns the width of the key span [start,
+	// end), in arbitrary units, such as the fraction of the key space it
+	// covers. It is used by WeightedReadAmplification to weight intervals by
+	// the portion of the key space they cover. By default, every interval has
+	// the same width.
+	KeySpaceWidth func(start, end []byte) float64
+
+	// FlushSplitTargetBytes, if positive, places flush split keys such that the
+	// estimated bytes of L0 between consecutive split keys are as close as
+	// possible to FlushSplitTargetBytes, instead of splitting once they exceed
+	// flushSplitMaxBytes scaled per FlushSplitPolicy. The flushSplitMaxBytes
+	// passed to NewL0SublevelsWithOptions and AddL0Files, and FlushSplitPolicy,
+	// are ignored in that case.
+	FlushSplitTargetBytes int64
+
+	// FlushSplitPolicy specifies how flushSplitMaxBytes is scaled to the
+	// threshold of bytes at which flush split keys are placed. It defaults to
+	// FlushSplitScaleBySublevels.
+	FlushSplitPolicy FlushSplitPolicy
+
+	// MinSplitIntervalBytes, if positive, is a floor on the estimated bytes
+	// between consecutive flush split keys: a split key is only placed once
+	// the bytes accumulated since the previous split key exceed both the
+	// flush split threshold and MinSplitIntervalBytes. This prevents flushes
+	// from being split into many tiny sstables when dense intervals with
+	// small byte estimates would otherwise each cross the threshold.
+	MinSplitIntervalBytes int64
+
+	// MaxCompactionFiles, if positive, bounds the number of files in the
+	// compactions picked by PickBaseCompaction and PickIntraL0Compaction, and
+	// in compactions extended by ExtendL0ForBaseCompactionTo. Candidates stop
+	// growing once another step would exceed the bound, like they do when
+	// growing too large in bytes. This bounds the file handles used by a
+	// compaction when many small files fit under the byte limits. Candidates
+	// that can't reach the minimum compaction depth within the bound are not
+	// picked.
+	MaxCompactionFiles int
+
+	// CacheBasePicks, if true, memoizes the result of PickBaseCompaction. A
+	// cached result is returned for repeated calls with the same arguments,
+	// until the compacting state of L0 is updated through
+	// InitCompactingFileInfo or UpdateStateForStartedCompaction. The compacting
+	// state of the Lbase files isn't checked on a cache hit, so callers must
+	// call InitCompactingFileInfo whenever the version changes or a compaction
+	// starts or finishes, including compactions of Lbase files alone, as the
+	// DB does before picking compactions.
+	CacheBasePicks bool
+}
+
+// FlushSplitPolicy specifies how the flushSplitMaxBytes passed to
+// NewL0SublevelsWithOptions and AddL0Files is turned into the threshold of
+// estimated L0 bytes between consecutive flush split keys. A split key is
+// placed at the start of an interval once the bytes accumulated since the
+// previous split key exceed the threshold.
+type FlushSplitPolicy int8
+
+const (
+	// FlushSplitScaleBySublevels multiplies flushSplitMaxBytes by the number of
+	// sublevels. As sublevels accumulate, split keys become fewer and further
+	// apart, which prevents excessive flush splitting when L0 is deep, as each
+	// flushed file would otherwise be split into many small files.
+	FlushSplitScaleBySublevels FlushSplitPolicy = iota
+	// FlushSplitFixed uses flushSplitMaxBytes as the threshold, regardless of
+	// the number of sublevels. Split keys stay dense as sublevels accumulate,
+	// so they are spaced by roughly flushSplitMaxBytes of L0 data, and their
+	// number grows with the size of L0 alone. This keeps flushed files narrow,
+	// which keeps base compactions narrow, at the cost of more flushed files.
+	FlushSplitFixed
+)
+
+// basePickCacheEntry is a memoized PickBaseCompaction result.
+type basePickCacheEntry struct {
+	generation         uint64
+	minCompactionDepth int
+	opts               L0PickOptions
+	// c is nil if no compaction was picked.
+	c *L0CompactionFiles
+}
+
+// matches returns true if the entry holds the result of PickBaseCompaction
+// with the specified arguments, at the specified generation.
+func (e *basePickCacheEntry) matches(
+	generation uint64, minCompactionDepth int, opts L0PickOptions,
+) bool {
+	if e.generation != generation || e.minCompactionDepth != minCompactionDepth {
+		return false
+	}
+	// OnFileAdded and IntervalScorer aren't compared, since picks with either
+	// set aren't cached.
+	a, b := e.opts, opts
+	if a.MaxSublevels != b.MaxSublevels ||
+		a.PrioritizeDeepest != b.PrioritizeDeepest ||
+		a.MergeAdjacentSeeds != b.MergeAdjacentSeeds ||
+		a.CreatedBefore != b.CreatedBefore ||
+		a.SkipCompactingSeeds != b.SkipCompactingSeeds ||
+		a.ByteTiebreak != b.ByteTiebreak ||
+		a.CenteredFileRadius != b.CenteredFileRadius ||
+		a.WideSeedFileBonus != b.WideSeedFileBonus ||
+		a.WideSeedFileMinIntervals != b.WideSeedFileMinIntervals ||
+		a.ClosedRectangles != b.ClosedRectangles ||
+		a.MaxIntervalSpan != b.MaxIntervalSpan ||
+		a.PreferFlushSplitAlignment != b.PreferFlushSplitAlignment {
+		return false
+	}
+	if (a.Limits == nil) != (b.Limits == nil) || (b.Limits != nil && *a.Limits != *b.Limits) {
+		return false
+	}
+	if (a.Avoid == nil) != (b.Avoid == nil) || len(a.BaseSplitKeys) != len(b.BaseSplitKeys) ||
+		len(a.Excluded) != len(b.Excluded) {
+		return false
+	}
+	for i := range b.Excluded {
+		if a.Excluded[i] != b.Excluded[i] {
+			return false
+		}
+	}
+	for i := range b.BaseSplitKeys {
+		if !bytes.Equal(a.BaseSplitKeys[i], b.BaseSplitKeys[i]) {
+			return false
+		}
+	}
+	return b.Avoid == nil || (bytes.Equal(a.Avoid.Start, b.Avoid.Start) &&
+		bytes.Equal(a.Avoid.End, b.Avoid.End))
+}
+
 type sublevelSorter []*FileMetadata
 
 // Len implements sort.Interface.
@@ -284,12 +531,34 @@ func (sl sublevelSorter) Swap(i, j int) {
 func NewL0Sublevels(
 	levelMetadata *LevelMetadata, cmp Compare, formatKey base.FormatKey, flushSplitMaxBytes int64,
 ) (*L0Sublevels, error) {
-	s := &L0Sublevels{cmp: cmp, formatKey: formatKey}
+	return NewL0SublevelsWithOptions(levelMetadata, cmp, formatKey, flushSplitMaxBytes, L0SublevelsOptions{})
+}
+
+// NewL0SublevelsWithOptions is like NewL0Sublevels, but constructs
+// L0Sublevels using the specified options. The options are retained by the
+// returned L0Sublevels, and carried over by AddL0Files.
+func NewL0SublevelsWithOptions(
+	levelMetadata *LevelMetadata,
+	cmp Compare,
+	formatKey base.FormatKey,
+	flushSplitMaxBytes int64,
+	opts L0SublevelsOptions,
+) (*L0Sublevels, error) {
+	if opts.FileIntervalBytes != nil && opts.EstimateIntervalBytes != nil {
+		return nil, errors.Errorf("pebble: at most one of FileIntervalBytes and EstimateIntervalBytes may be set")
+	}
+	if opts.FlushSplitPolicy != FlushSplitScaleBySublevels && opts.FlushSplitPolicy != FlushSplitFixed {
+		return nil, errors.Errorf("pebble: unknown flush split policy %d", opts.FlushSplitPolicy)
+	}
+	s := &L0Sublevels{cmp: cmp, formatKey: formatKey, opts: opts}
 	s.levelMetadata = levelMetadata
 	keys := make([]intervalKeyTemp, 0, 2*s.levelMetadata.Len())
 	iter := levelMetadata.Iter()
 	for i, f := 0, iter.First(); f != nil; i, f = i+1, iter.Next() {
 		f.L0Index = i
+		// f.Smallest and f.Largest are the overall bounds of the file, spanning
+		// both its point keys and its range keys, so files overlapping only
+		// through range keys share intervals.
 		keys = append(keys, intervalKeyTemp{
 			intervalKey: intervalKey{key: f.Smallest.UserKey},
 			fileMeta:    f,
@@ -322,7 +591,10 @@ func NewL0Sublevels(
 			return nil, err
 		}
 	}
-	// Sort each sublevel in increasing key order.
+	// Sort each sublevel in increasing key order. addFileToSublevels appends
+	// files to their sublevel in seqnum order, which need not be key order.
+	// Sorting each sublevel once here is cheaper than keeping sublevels sorted
+	// on every insertion, which would require shifting elements.
 	for i := range s.levelFiles {
 		sort.Sort(sublevelSorter(s.levelFiles[i]))
 	}
@@ -450,11 +722,26 @@ func (s *L0Sublevels) AddL0Files(
 	}
 	s.addL0FilesCalled = true
 
+	if s.opts.FileIntervalBytes != nil || s.opts.EstimateIntervalBytes != nil {
+		// The incremental re-estimation of bytes in intervals split by the added
+		// files below assumes bytes are spread uniformly across a file's
+		// intervals. Rebuild from scratch instead.
+		return NewL0SublevelsWithOptions(levelMetadata, s.cmp, s.formatKey, flushSplitMaxBytes, s.opts)
+	}
+
 	// Start with a shallow copy of s.
 	newVal := &L0Sublevels{}
 	*newVal = *s
 
 	newVal.addL0FilesCalled = false
+	newVal.basePickCache = nil
+	// The recorded compacting state is reused by recordCompactingState, so it
+	// must not be shared with s.
+	newVal.compactingInitialized = false
+	newVal.compactingFiles = nil
+	newVal.compactingBaseBounds = nil
+	newVal.compactingBaseKeys = nil
+	newVal.compactingBaseMatched = nil
 	newVal.levelMetadata = levelMetadata
 	// Deep copy levelFiles and Levels, as they are mutated and sorted below.
 	// Shallow copies of slices that we just append to, are okay.
@@ -633,9 +920,182 @@ func (s *L0Sublevels) AddL0Files(
 
 	newVal.flushSplitUserKeys = nil
 	newVal.calculateFlushSplitKeys(flushSplitMaxBytes)
+	if invariants.Enabled {
+		if err := newVal.DebugCheckIndices(); err != nil {
+			panic(err)
+		}
+		if err := newVal.CheckInvariants(); err != nil {
+			panic(err)
+		}
+	}
+	return newVal, nil
+}
+
+// RemoveL0Files builds a new L0Sublevels for when the only change since the
+// receiver L0Sublevels was the removal of the specified files from L0, such as
+// when a compaction out of L0 completes. The levelMetadata parameter
+// corresponds to the new L0 post removal of files. Interval keys that are no
+// longer a bound of any remaining file are dropped, merging the intervals on
+// either side of them, and the remaining files are placed in sublevels again,
+// so the result is the same as that of NewL0Sublevels on levelMetadata. This
+// avoids sorting the bounds of all remaining files again, as NewL0Sublevels
+// does. As with NewL0Sublevels, the compacting state of the files is not
+// carried over; InitCompactingFileInfo must be called on the result.
+//
+// Like AddL0Files, this updates the interval indices cached in the remaining
+// files, so the receiver must not be used once this returns successfully. An
+// error is returned, without modifying any state, if a removed file is not
+// part of the receiver, or if levelMetadata does not hold exactly the files of
+// the receiver that were not removed.
+func (s *L0Sublevels) RemoveL0Files(
+	removed []*FileMetadata, flushSplitMaxBytes int64, levelMetadata *LevelMetadata,
+) (*L0Sublevels, error) {
+	isRemoved := newBitSet(s.levelMetadata.Len())
+	for _, f := range removed {
+		if _, _, ok := s.FileIntervalRange(f); !ok {
+			return nil, errors.Errorf("pebble: removed file %s is not in L0 sublevels", f.FileNum)
+		}
+		if isRemoved.Contains(f.L0Index) {
+			return nil, errors.Errorf("pebble: file %s removed more than once", f.FileNum)
+		}
+		isRemoved.markBit(f.L0Index)
+	}
+	if n := s.levelMetadata.Len() - len(removed); levelMetadata.Len() != n {
+		return nil, errors.Errorf("pebble: expected %d L0 files after removal, got %d", n, levelMetadata.Len())
+	}
+	// Mark the intervals starting at a bound of a remaining file. These are the
+	// intervals that NewL0Sublevels would create for the remaining files.
+	remaining := make([]*FileMetadata, 0, levelMetadata.Len())
+	referenced := newBitSet(len(s.orderedIntervals))
+	iter := levelMetadata.Iter()
+	for f := iter.First(); f != nil; f = iter.Next() {
+		if _, _, ok := s.FileIntervalRange(f); !ok || isRemoved.Contains(f.L0Index) {
+			return nil, errors.Errorf("pebble: remaining file %s is not in L0 sublevels", f.FileNum)
+		}
+		referenced.markBit(f.minIntervalIndex)
+		referenced.markBit(f.maxIntervalIndex + 1)
+		remaining = append(remaining, f)
+	}
+
+	newVal := &L0Sublevels{cmp: s.cmp, formatKey: s.formatKey, opts: s.opts}
+	newVal.levelMetadata = levelMetadata
+	oldToNewMap := make([]int, len(s.orderedIntervals))
+	newVal.orderedIntervals = make([]fileInterval, 0, referenced.count())
+	for i := range s.orderedIntervals {
+		if !referenced.Contains(i) {
+			oldToNewMap[i] = -1
+			continue
+		}
+		newIndex := len(newVal.orderedIntervals)
+		oldToNewMap[i] = newIndex
+		newVal.orderedIntervals = append(newVal.orderedIntervals, fileInterval{
+			index:                 newIndex,
+			startKey:              s.orderedIntervals[i].startKey,
+			filesMinIntervalIndex: newIndex,
+			filesMaxIntervalIndex: newIndex,
+		})
+	}
+	for i, f := range remaining {
+		f.L0Index = i
+		// Both bounds of f are referenced. maxIntervalIndex is inclusive, so it
+		// is the interval before the one starting at the file's largest key.
+		f.minIntervalIndex = oldToNewMap[f.minIntervalIndex]
+		f.maxIntervalIndex = oldToNewMap[f.maxIntervalIndex+1] - 1
+		if err := newVal.addFileToSublevels(f, false /* checkInvariant */); err != nil {
+			return nil, err
+		}
+	}
+	for i := range newVal.levelFiles {
+		sort.Sort(sublevelSorter(newVal.levelFiles[i]))
+	}
+
+	// Construct a parallel slice of sublevel B-Trees.
+	// TODO(jackson): Consolidate and only use the B-Trees.
+	for _, sublevelFiles := range newVal.levelFiles {
+		tr, ls := makeBTree(btreeCmpSmallestKey(newVal.cmp), sublevelFiles)
+		newVal.Levels = append(newVal.Levels, ls)
+		tr.release()
+	}
+
+	newVal.calculateFlushSplitKeys(flushSplitMaxBytes)
+	if invariants.Enabled {
+		if err := newVal.DebugCheckIndices(); err != nil {
+			panic(err)
+		}
+		if err := newVal.CheckInvariants(); err != nil {
+			panic(err)
+		}
+	}
 	return newVal, nil
 }
 
+// DebugCheckIndices recomputes the interval range of every L0 file from its
+// bounds and the current intervals, and returns an error if it differs from
+// the interval range cached in the file. The cached ranges must be adjusted
+// whenever intervals are inserted or removed, which makes them prone to drift
+// when L0Sublevels is updated incrementally, as in AddL0Files.
+func (s *L0Sublevels) DebugCheckIndices() error {
+	// intervalIndex returns the index of the interval starting at key, or -1 if
+	// there is no such interval.
+	intervalIndex := func(key intervalKey) int {
+		i := sort.Search(len(s.orderedIntervals), func(i int) bool {
+			return intervalKeyCompare(s.cmp, s.orderedIntervals[i].startKey, key) >= 0
+		})
+		if i == len(s.orderedIntervals) ||
+			intervalKeyCompare(s.cmp, s.orderedIntervals[i].startKey, key) != 0 {
+			return -1
+		}
+		return i
+	}
+	for i := range s.orderedIntervals {
+		if s.orderedIntervals[i].index != i {
+			return errors.Errorf("pebble: interval %d has index %d", i, s.orderedIntervals[i].index)
+		}
+	}
+	iter := s.levelMetadata.Iter()
+	for f := iter.First(); f != nil; f = iter.Next() {
+		minIntervalIndex := intervalIndex(intervalKey{key: f.Smallest.UserKey})
+		maxIntervalIndex := intervalIndex(intervalKey{
+			key:       f.Largest.UserKey,
+			isLargest: !f.Largest.IsExclusiveSentinel(),
+		})
+		if minIntervalIndex < 0 || maxIntervalIndex < 0 {
+			return errors.Errorf("pebble: no interval starts at a bound of file %s", f.FileNum)
+		}
+		// maxIntervalIndex is inclusive, so it is the interval before the one
+		// starting at the file's largest key.
+		maxIntervalIndex--
+		if f.minIntervalIndex != minIntervalIndex || f.maxIntervalIndex != maxIntervalIndex {
+			return errors.Errorf("pebble: file %s has interval range [%d, %d], expected [%d, %d]",
+				f.FileNum, f.minIntervalIndex, f.maxIntervalIndex, minIntervalIndex, maxIntervalIndex)
+		}
+	}
+	return nil
+}
+
+// CheckInvariants returns an error if the files within a sublevel overlap, or
+// if a file's SubLevel does not match the sublevel it is in. Files within a
+// sublevel must be in increasing key order and not share any interval.
+func (s *L0Sublevels) CheckInvariants() error {
+	for sublevel := range s.Levels {
+		var prev *FileMetadata
+		iter := s.Levels[sublevel].Iter()
+		for f := iter.First(); f != nil; f = iter.Next() {
+			if f.SubLevel != sublevel {
+				return errors.Errorf("pebble: file %s in sublevel %d has sublevel %d",
+					f.FileNum, sublevel, f.SubLevel)
+			}
+			if prev != nil && prev.maxIntervalIndex >= f.minIntervalIndex {
+				return errors.Errorf("pebble: files %s and %s in sublevel %d overlap: interval ranges [%d, %d] and [%d, %d]",
+					prev.FileNum, f.FileNum, sublevel,
+					prev.minIntervalIndex, prev.maxIntervalIndex, f.minIntervalIndex, f.maxIntervalIndex)
+			}
+			prev = f
+		}
+	}
+	return nil
+}
+
 // addFileToSublevels is called during L0Sublevels generation, and adds f to
 // the correct sublevel's levelFiles, the relevant intervals' files slices, and
 // sets interval indices on f. This method, if called successively on multiple
@@ -644,11 +1104,28 @@ func (s *L0Sublevels) AddL0Files(
 // errInvalidL0SublevelsOpt if that invariant isn't held.
 func (s *L0Sublevels) addFileToSublevels(f *FileMetadata, checkInvariant bool) error {
 	// This is a simple and not very accurate estimate of the number of
-	// bytes this SSTable contributes to the intervals it is a part of.
-	//
-	// TODO(bilal): Call EstimateDiskUsage in sstable.Reader with interval
-	// bounds to get a better estimate for each interval.
+	// bytes this SSTable contributes to the intervals it is a part of. It is
+	// overridden by s.opts.FileIntervalBytes or s.opts.EstimateIntervalBytes,
+	// if set.
 	interpolatedBytes := f.Size / uint64(f.maxIntervalIndex-f.minIntervalIndex+1)
+	var intervalBytes []uint64
+	if s.opts.FileIntervalBytes != nil {
+		bounds := make([][]byte, 0, f.maxIntervalIndex-f.minIntervalIndex+2)
+		for i := f.minIntervalIndex; i <= f.maxIntervalIndex+1; i++ {
+			bounds = append(bounds, s.orderedIntervals[i].startKey.key)
+		}
+		intervalBytes = s.opts.FileIntervalBytes(f, bounds)
+		if len(intervalBytes) != len(bounds)-1 {
+			return errors.Errorf("pebble: expected %d interval byte estimates for file %s, got %d",
+				len(bounds)-1, f.FileNum, len(intervalBytes))
+		}
+	} else if s.opts.EstimateIntervalBytes != nil {
+		intervalBytes = make([]uint64, 0, f.maxIntervalIndex-f.minIntervalIndex+1)
+		for i := f.minIntervalIndex; i <= f.maxIntervalIndex; i++ {
+			intervalBytes = append(intervalBytes, s.opts.EstimateIntervalBytes(
+				f, s.orderedIntervals[i].startKey.key, s.orderedIntervals[i+1].startKey.key))
+		}
+	}
 	s.fileBytes += f.Size
 	subLevel := 0
 	// Update state in every fileInterval for this file.
@@ -663,7 +1140,11 @@ func (s *L0Sublevels) addFileToSublevels(f *FileMetadata, checkInvariant bool) e
 			}
 			subLevel = interval.files[len(interval.files)-1].SubLevel + 1
 		}
-		interval.estimatedBytes += interpolatedBytes
+		if intervalBytes != nil {
+			interval.estimatedBytes += intervalBytes[i-f.minIntervalIndex]
+		} else {
+			interval.estimatedBytes += interpolatedBytes
+		}
 		if f.minIntervalIndex < interval.filesMinIntervalIndex {
 			interval.filesMinIntervalIndex = f.minIntervalIndex
 		}
@@ -684,69 +1165,451 @@ func (s *L0Sublevels) addFileToSublevels(f *FileMetadata, checkInvariant bool) e
 	return nil
 }
 
+// RecomputeSubLevels recomputes the sublevels of the specified L0 files
+// against the current intervals, placing each file in the lowest sublevel
+// above all older files it overlaps, and updates Levels accordingly. The
+// sublevels of other files are left unchanged, except that sublevels left
+// empty are removed, shifting down the sublevels above them. Returns an error
+// without modifying any state if a recomputed sublevel would not be below the
+// sublevels of all newer overlapping files. Flush split keys are not
+// recomputed.
+//
+// Requires DB.mu to be held.
+func (s *L0Sublevels) RecomputeSubLevels(files []*FileMetadata) error {
+	sorted := append([]*FileMetadata(nil), files...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].L0Index < sorted[j].L0Index
+	})
+	newSubLevels := make(map[*FileMetadata]int, len(sorted))
+	subLevelOf := func(f *FileMetadata) int {
+		if subLevel, ok := newSubLevels[f]; ok {
+			return subLevel
+		}
+		return f.SubLevel
+	}
+	// Files in an interval are ordered from oldest to youngest, so older files
+	// are the ones preceding f.
+	for _, f := range sorted {
+		subLevel := 0
+		for i := f.minIntervalIndex; i <= f.maxIntervalIndex; i++ {
+			for _, g := range s.orderedIntervals[i].files {
+				if g == f {
+					break
+				}
+				if subLevel <= subLevelOf(g) {
+					subLevel = subLevelOf(g) + 1
+				}
+			}
+		}
+		newSubLevels[f] = subLevel
+	}
+	for _, f := range sorted {
+		for i := f.minIntervalIndex; i <= f.maxIntervalIndex; i++ {
+			intervalFiles := s.orderedIntervals[i].files
+			for j := 1; j < len(intervalFiles); j++ {
+				older, newer := intervalFiles[j-1], intervalFiles[j]
+				if subLevelOf(older) >= subLevelOf(newer) {
+					return errors.Errorf(
+						"pebble: file %s in sublevel %d is not below newer overlapping file %s in sublevel %d",
+						older.FileNum, subLevelOf(older), newer.FileNum, subLevelOf(newer))
+				}
+			}
+		}
+	}
+	for f, subLevel := range newSubLevels {
+		f.SubLevel = subLevel
+	}
+
+	var levelFiles [][]*FileMetadata
+	iter := s.levelMetadata.Iter()
+	for f := iter.First(); f != nil; f = iter.Next() {
+		for len(levelFiles) <= f.SubLevel {
+			levelFiles = append(levelFiles, nil)
+		}
+		levelFiles[f.SubLevel] = append(levelFiles[f.SubLevel], f)
+	}
+	n := 0
+	for _, sublevelFiles := range levelFiles {
+		if len(sublevelFiles) == 0 {
+			continue
+		}
+		for _, f := range sublevelFiles {
+			f.SubLevel = n
+		}
+		sort.Sort(sublevelSorter(sublevelFiles))
+		levelFiles[n] = sublevelFiles
+		n++
+	}
+	s.levelFiles = levelFiles[:n]
+	s.Levels = make([]LevelSlice, 0, n)
+	for _, sublevelFiles := range s.levelFiles {
+		tr, ls := makeBTree(btreeCmpSmallestKey(s.cmp), sublevelFiles)
+		s.Levels = append(s.Levels, ls)
+		tr.release()
+	}
+	s.generation++
+	return nil
+}
+
 func (s *L0Sublevels) calculateFlushSplitKeys(flushSplitMaxBytes int64) {
+	s.flushSplitFingerprint = s.filesFingerprint()
+	s.flushSplitMaxBytes = flushSplitMaxBytes
+	s.flushSplitUserKeys = nil
+	s.flushSplitIntervals = nil
+	s.flushSplitBytes = nil
+	threshold, ok := s.flushSplitThreshold()
+	s.flushSplitThresholdBytes = threshold
+	if !ok {
+		return
+	}
 	var cumulativeBytes uint64
-	// Multiply flushSplitMaxBytes by the number of sublevels. This prevents
-	// excessive flush splitting when the number of sublevels increases.
-	flushSplitMaxBytes *= int64(len(s.levelFiles))
 	for i := 0; i < len(s.orderedIntervals); i++ {
 		interval := &s.orderedIntervals[i]
-		if flushSplitMaxBytes > 0 && cumulativeBytes > uint64(flushSplitMaxBytes) &&
-			(len(s.flushSplitUserKeys) == 0 ||
-				!bytes.Equal(interval.startKey.key, s.flushSplitUserKeys[len(s.flushSplitUserKeys)-1])) {
+		if s.shouldSplitFlushAt(interval, cumulativeBytes, threshold) {
 			s.flushSplitUserKeys = append(s.flushSplitUserKeys, interval.startKey.key)
+			s.flushSplitIntervals = append(s.flushSplitIntervals, i)
+			s.flushSplitBytes = append(s.flushSplitBytes, cumulativeBytes)
 			cumulativeBytes = 0
 		}
-		cumulativeBytes += s.orderedIntervals[i].estimatedBytes
+		cumulativeBytes += interval.estimatedBytes
 	}
 }
 
-// InitCompactingFileInfo initializes internal flags relating to compacting
-// files. Must be called after sublevel initialization.
+// flushSplitThreshold returns the threshold of bytes that flush split keys are
+// placed at, and false if no flush split keys should be placed.
+//
+// If opts.FlushSplitTargetBytes is set, flush split keys are placed such that
+// the estimated bytes between consecutive split keys are as close as possible
+// to the target. Otherwise, a split key is placed at the start of an interval
+// once the bytes accumulated since the previous split key exceed
+// flushSplitMaxBytes, scaled per opts.FlushSplitPolicy. By default, it is
+// multiplied by the number of sublevels. This prevents excessive flush
+// splitting when the number of sublevels increases.
+func (s *L0Sublevels) flushSplitThreshold() (uint64, bool) {
+	if s.opts.FlushSplitTargetBytes > 0 {
+		return uint64(s.opts.FlushSplitTargetBytes), true
+	}
+	if s.flushSplitMaxBytes <= 0 || len(s.levelFiles) == 0 {
+		return 0, false
+	}
+	if s.opts.FlushSplitPolicy == FlushSplitFixed {
+		return uint64(s.flushSplitMaxBytes), true
+	}
+	// The product saturates instead of overflowing, as an overflow could wrap
+	// around to a small threshold and split flushes at every interval.
+	if n := int64(len(s.levelFiles)); s.flushSplitMaxBytes > math.MaxInt64/n {
+		return math.MaxInt64, true
+	}
+	return uint64(s.flushSplitMaxBytes * int64(len(s.levelFiles))), true
+}
+
+// shouldSplitFlushAt returns true if a flush split key should be placed at the
+// start of the specified interval, given the bytes accumulated since the
+// previous split key and the threshold returned by flushSplitThreshold.
+//
+// With a target, a split key is placed at the start of an interval if the
+// bytes accumulated since the previous split key are closer to the target
+// without the interval than with it. Either way, no split key is placed until
+// the accumulated bytes exceed opts.MinSplitIntervalBytes. Two intervals can
+// start at the same user key, in which case only the first of them gets a
+// split key.
+func (s *L0Sublevels) shouldSplitFlushAt(
+	interval *fileInterval, cumulativeBytes, threshold uint64,
+) bool {
+	var split bool
+	if s.opts.FlushSplitTargetBytes > 0 {
+		withInterval := cumulativeBytes + interval.estimatedBytes
+		split = cumulativeBytes >= threshold ||
+			(cumulativeBytes > 0 && withInterval > threshold &&
+				threshold-cumulativeBytes <= withInterval-threshold)
+	} else {
+		split = cumulativeBytes > threshold
+	}
+	if s.opts.MinSplitIntervalBytes > 0 && cumulativeBytes <= uint64(s.opts.MinSplitIntervalBytes) {
+		split = false
+	}
+	return split && (len(s.flushSplitUserKeys) == 0 ||
+		!bytes.Equal(interval.startKey.key, s.flushSplitUserKeys[len(s.flushSplitUserKeys)-1]))
+}
+
+// RecomputeFlushSplitKeysInRange recomputes the flush split keys after the
+// estimated bytes of the intervals overlapping the user key range [start, end]
+// have changed, such as after an ingestion into that range. Since split keys
+// are placed greedily from left to right, placement is restarted from the
+// last split key before the range, and the previous split keys are spliced
+// back in as soon as a recomputed split key beyond the range coincides with a
+// previous one, as every split key placed after that is unaffected by the
+// change. If the number of sublevels changed the threshold split keys are
+// placed at, all split keys are recomputed.
+//
+// The result is the same as recomputing all flush split keys, as long as the
+// estimated bytes did not change outside of the range.
+func (s *L0Sublevels) RecomputeFlushSplitKeysInRange(start, end []byte) {
+	threshold, ok := s.flushSplitThreshold()
+	if !ok || threshold != s.flushSplitThresholdBytes {
+		s.calculateFlushSplitKeys(s.flushSplitMaxBytes)
+		return
+	}
+	lo, hi := s.intervalRange(start, end)
+	oldKeys, oldIntervals, oldBytes := s.flushSplitUserKeys, s.flushSplitIntervals, s.flushSplitBytes
+	// n is the index of the first split key at or beyond the range.
+	n := sort.SearchInts(oldIntervals, lo)
+	i := 0
+	var cumulativeBytes uint64
+	if n > 0 {
+		// Keep the last split key before the range, and restart placement
+		// right after it, where the accumulated bytes were reset.
+		i = oldIntervals[n-1]
+		cumulativeBytes = s.orderedIntervals[i].estimatedBytes
+		i++
+	}
+	// The splices copy the slices, since they may be shared with the
+	// L0Sublevels that AddL0Files was called on.
+	s.flushSplitUserKeys = append([][]byte(nil), oldKeys[:n]...)
+	s.flushSplitIntervals = append([]int(nil), oldIntervals[:n]...)
+	s.flushSplitBytes = append([]uint64(nil), oldBytes[:n]...)
+	for m := n; i < len(s.orderedIntervals); i++ {
+		interval := &s.orderedIntervals[i]
+		if s.shouldSplitFlushAt(interval, cumulativeBytes, threshold) {
+			for m < len(oldIntervals) && oldIntervals[m] < i {
+				m++
+			}
+			if i >= hi && m < len(oldIntervals) && oldIntervals[m] == i {
+				// The bytes preceding the coinciding split key may have
+				// changed, but not the bytes preceding the split keys after
+				// it.
+				s.flushSplitUserKeys = append(s.flushSplitUserKeys, oldKeys[m:]...)
+				s.flushSplitIntervals = append(s.flushSplitIntervals, oldIntervals[m:]...)
+				s.flushSplitBytes = append(s.flushSplitBytes, cumulativeBytes)
+				s.flushSplitBytes = append(s.flushSplitBytes, oldBytes[m+1:]...)
+				break
+			}
+			s.flushSplitUserKeys = append(s.flushSplitUserKeys, interval.startKey.key)
+			s.flushSplitIntervals = append(s.flushSplitIntervals, i)
+			s.flushSplitBytes = append(s.flushSplitBytes, cumulativeBytes)
+			cumulativeBytes = 0
+		}
+		cumulativeBytes += interval.estimatedBytes
+	}
+	s.flushSplitFingerprint = s.filesFingerprint()
+}
+
+// ClearCompactingState resets the internal flags relating to compacting files,
+// as if no files were compacting, without looking at the files' compacting
+// state. InitCompactingFileInfo recomputes the flags from there.
 //
 // Requires DB.mu to be held.
-func (s *L0Sublevels) InitCompactingFileInfo(inProgress []L0Compaction) {
+func (s *L0Sublevels) ClearCompactingState() {
+	s.generation++
 	for i := range s.orderedIntervals {
 		s.orderedIntervals[i].compactingFileCount = 0
 		s.orderedIntervals[i].isBaseCompacting = false
 		s.orderedIntervals[i].intervalRangeIsBaseCompacting = false
 	}
+}
+
+// InitCompactingFileInfo initializes internal flags relating to compacting
+// files. Must be called after sublevel initialization.
+//
+// The compacting state is only recomputed if the compacting files, or the
+// in-progress base compactions, changed since the last call, or if the
+// compacting state was updated otherwise since, such as through
+// UpdateStateForStartedCompaction. This makes repeated calls cheap when many
+// compactions are running, but none started or finished. The cached
+// PickBaseCompaction result is dropped either way, since it also depends on
+// the compacting state of Lbase files, which isn't tracked here.
+//
+// Requires DB.mu to be held.
+func (s *L0Sublevels) InitCompactingFileInfo(inProgress []L0Compaction) {
+	s.basePickCache = nil
+	if s.compactingInitialized && s.compactingGeneration == s.generation &&
+		s.compactingStateUnchanged(inProgress) {
+		return
+	}
+	s.initCompactingFileInfo(inProgress)
+	s.recordCompactingState(inProgress)
+	s.compactingGeneration = s.generation
+	s.compactingInitialized = true
+}
+
+// compactingBounds are the bounds of an in-progress base compaction, as
+// recorded by recordCompactingState. The user keys are stored back to back in
+// L0Sublevels.compactingBaseKeys, starting at offset.
+type compactingBounds struct {
+	offset, smallestLen, largestLen int
+	largestExclusive                bool
+}
+
+// keys returns the user keys of the bounds b, given the recorded keys.
+func (b *compactingBounds) keys(keys []byte) (smallest, largest []byte) {
+	smallest = keys[b.offset : b.offset+b.smallestLen]
+	largest = keys[b.offset+b.smallestLen : b.offset+b.smallestLen+b.largestLen]
+	return smallest, largest
+}
+
+// compareBounds orders compaction bounds by smallest key, largest key and
+// then whether the largest key is exclusive, exclusive bounds first.
+func (s *L0Sublevels) compareBounds(
+	aSmallest, aLargest []byte, aExclusive bool, bSmallest, bLargest []byte, bExclusive bool,
+) int {
+	if v := s.cmp(aSmallest, bSmallest); v != 0 {
+		return v
+	}
+	if v := s.cmp(aLargest, bLargest); v != 0 {
+		return v
+	}
+	switch {
+	case aExclusive == bExclusive:
+		return 0
+	case aExclusive:
+		return -1
+	default:
+		return +1
+	}
+}
+
+// compactingFileKey returns the value f contributes to compactingFiles: its
+// L0Index, and whether it is being compacted within L0.
+func compactingFileKey(f *FileMetadata) int {
+	k := f.L0Index << 1
+	if f.IsIntraL0Compacting {
+		k |= 1
+	}
+	return k
+}
 
+// compactingStateUnchanged returns true if the compacting L0 files and the
+// in-progress base compactions are the ones recorded by the last
+// recordCompactingState call. These are the inputs to the compacting state of
+// the intervals. In-progress intra-L0 compactions don't contribute to it
+// beyond their files, so they are ignored.
+func (s *L0Sublevels) compactingStateUnchanged(inProgress []L0Compaction) bool {
+	n := 0
 	iter := s.levelMetadata.Iter()
 	for f := iter.First(); f != nil; f = iter.Next() {
-		if invariants.Enabled {
-			if !bytes.Equal(s.orderedIntervals[f.minIntervalIndex].startKey.key, f.Smallest.UserKey) {
-				panic(fmt.Sprintf("f.minIntervalIndex in FileMetadata out of sync with intervals in L0Sublevels: %s != %s",
-					s.formatKey(s.orderedIntervals[f.minIntervalIndex].startKey.key), s.formatKey(f.Smallest.UserKey)))
-			}
-			if !bytes.Equal(s.orderedIntervals[f.maxIntervalIndex+1].startKey.key, f.Largest.UserKey) {
-				panic(fmt.Sprintf("f.maxIntervalIndex in FileMetadata out of sync with intervals in L0Sublevels: %s != %s",
-					s.formatKey(s.orderedIntervals[f.maxIntervalIndex+1].startKey.key), s.formatKey(f.Smallest.UserKey)))
-			}
-		}
 		if !f.IsCompacting() {
 			continue
 		}
-		for i := f.minIntervalIndex; i <= f.maxIntervalIndex; i++ {
-			interval := &s.orderedIntervals[i]
-			interval.compactingFileCount++
-			if !f.IsIntraL0Compacting {
-				// If f.Compacting && !f.IsIntraL0Compacting, this file is
-				// being compacted to Lbase.
-				interval.isBaseCompacting = true
-			}
+		if n == len(s.compactingFiles) || s.compactingFiles[n] != compactingFileKey(f) {
+			return false
 		}
+		n++
 	}
-
-	// Some intervals may be base compacting without the files contained
-	// within those intervals being marked as compacting. This is possible if
-	// the files were added after the compaction initiated, and the active
-	// compaction files straddle the input file. Mark these intervals as base
-	// compacting.
-	for _, c := range inProgress {
-		startIK := intervalKey{key: c.Smallest.UserKey, isLargest: false}
-		endIK := intervalKey{key: c.Largest.UserKey, isLargest: !c.Largest.IsExclusiveSentinel()}
-		start := sort.Search(len(s.orderedIntervals), func(i int) bool {
+	if n != len(s.compactingFiles) {
+		return false
+	}
+	// The in-progress base compactions may be in any order, so each one is
+	// matched against a distinct recorded bounds, found by binary search.
+	n = 0
+	bounds := s.compactingBaseBounds
+	s.compactingBaseMatched.reset(len(bounds))
+	for i := range inProgress {
+		c := &inProgress[i]
+		if c.IsIntraL0 {
+			continue
+		}
+		exclusive := c.Largest.IsExclusiveSentinel()
+		compare := func(j int) int {
+			smallest, largest := bounds[j].keys(s.compactingBaseKeys)
+			return s.compareBounds(smallest, largest, bounds[j].largestExclusive,
+				c.Smallest.UserKey, c.Largest.UserKey, exclusive)
+		}
+		j := sort.Search(len(bounds), func(j int) bool { return compare(j) >= 0 })
+		for j < len(bounds) && s.compactingBaseMatched.Contains(j) {
+			j++
+		}
+		if j == len(bounds) || compare(j) != 0 {
+			return false
+		}
+		s.compactingBaseMatched.markBit(j)
+		n++
+	}
+	return n == len(bounds)
+}
+
+// recordCompactingState records the compacting L0 files and copies of the
+// bounds of the in-progress base compactions, for compactingStateUnchanged.
+// The storage of the previously recorded state is reused.
+func (s *L0Sublevels) recordCompactingState(inProgress []L0Compaction) {
+	s.compactingFiles = s.compactingFiles[:0]
+	iter := s.levelMetadata.Iter()
+	for f := iter.First(); f != nil; f = iter.Next() {
+		if f.IsCompacting() {
+			s.compactingFiles = append(s.compactingFiles, compactingFileKey(f))
+		}
+	}
+	s.compactingBaseBounds = s.compactingBaseBounds[:0]
+	s.compactingBaseKeys = s.compactingBaseKeys[:0]
+	for _, c := range inProgress {
+		if c.IsIntraL0 {
+			continue
+		}
+		b := compactingBounds{
+			offset:           len(s.compactingBaseKeys),
+			smallestLen:      len(c.Smallest.UserKey),
+			largestLen:       len(c.Largest.UserKey),
+			largestExclusive: c.Largest.IsExclusiveSentinel(),
+		}
+		s.compactingBaseKeys = append(s.compactingBaseKeys, c.Smallest.UserKey...)
+		s.compactingBaseKeys = append(s.compactingBaseKeys, c.Largest.UserKey...)
+		// Insert b in sorted order. There are few in-progress compactions, so
+		// an insertion sort suffices.
+		s.compactingBaseBounds = append(s.compactingBaseBounds, b)
+		j := len(s.compactingBaseBounds) - 1
+		bSmallest, bLargest := b.keys(s.compactingBaseKeys)
+		for ; j > 0; j-- {
+			prev := &s.compactingBaseBounds[j-1]
+			prevSmallest, prevLargest := prev.keys(s.compactingBaseKeys)
+			if s.compareBounds(bSmallest, bLargest, b.largestExclusive,
+				prevSmallest, prevLargest, prev.largestExclusive) >= 0 {
+				break
+			}
+			s.compactingBaseBounds[j] = s.compactingBaseBounds[j-1]
+		}
+		s.compactingBaseBounds[j] = b
+	}
+}
+
+// initCompactingFileInfo recomputes the compacting state of the intervals from
+// scratch. See InitCompactingFileInfo.
+func (s *L0Sublevels) initCompactingFileInfo(inProgress []L0Compaction) {
+	s.ClearCompactingState()
+
+	iter := s.levelMetadata.Iter()
+	for f := iter.First(); f != nil; f = iter.Next() {
+		if invariants.Enabled {
+			if !bytes.Equal(s.orderedIntervals[f.minIntervalIndex].startKey.key, f.Smallest.UserKey) {
+				panic(fmt.Sprintf("f.minIntervalIndex in FileMetadata out of sync with intervals in L0Sublevels: %s != %s",
+					s.formatKey(s.orderedIntervals[f.minIntervalIndex].startKey.key), s.formatKey(f.Smallest.UserKey)))
+			}
+			if !bytes.Equal(s.orderedIntervals[f.maxIntervalIndex+1].startKey.key, f.Largest.UserKey) {
+				panic(fmt.Sprintf("f.maxIntervalIndex in FileMetadata out of sync with intervals in L0Sublevels: %s != %s",
+					s.formatKey(s.orderedIntervals[f.maxIntervalIndex+1].startKey.key), s.formatKey(f.Smallest.UserKey)))
+			}
+		}
+		if !f.IsCompacting() {
+			continue
+		}
+		for i := f.minIntervalIndex; i <= f.maxIntervalIndex; i++ {
+			interval := &s.orderedIntervals[i]
+			interval.compactingFileCount++
+			if !f.IsIntraL0Compacting {
+				// If f.Compacting && !f.IsIntraL0Compacting, this file is
+				// being compacted to Lbase.
+				interval.isBaseCompacting = true
+			}
+		}
+	}
+
+	// Some intervals may be base compacting without the files contained
+	// within those intervals being marked as compacting. This is possible if
+	// the files were added after the compaction initiated, and the active
+	// compaction files straddle the input file. Mark these intervals as base
+	// compacting.
+	for _, c := range inProgress {
+		startIK := intervalKey{key: c.Smallest.UserKey, isLargest: false}
+		endIK := intervalKey{key: c.Largest.UserKey, isLargest: !c.Largest.IsExclusiveSentinel()}
+		start := sort.Search(len(s.orderedIntervals), func(i int) bool {
 			return intervalKeyCompare(s.cmp, s.orderedIntervals[i].startKey, startIK) >= 0
 		})
 		end := sort.Search(len(s.orderedIntervals), func(i int) bool {
@@ -776,12 +1639,233 @@ func (s *L0Sublevels) InitCompactingFileInfo(inProgress []L0Compaction) {
 	}
 }
 
+// Equal returns true if the receiver and other are semantically equal: the
+// same files, identified by file number, are in the same sublevels, and both
+// have the same intervals, with the same estimated bytes, and the same flush
+// split keys. This is useful to check an incrementally updated L0Sublevels,
+// such as one returned by AddL0Files, against one built from scratch. The
+// compacting state is not compared.
+func (s *L0Sublevels) Equal(other *L0Sublevels) bool {
+	if len(s.levelFiles) != len(other.levelFiles) ||
+		len(s.orderedIntervals) != len(other.orderedIntervals) ||
+		len(s.flushSplitUserKeys) != len(other.flushSplitUserKeys) {
+		return false
+	}
+	for sl := range s.levelFiles {
+		if len(s.levelFiles[sl]) != len(other.levelFiles[sl]) {
+			return false
+		}
+		for i, f := range s.levelFiles[sl] {
+			if f.FileNum != other.levelFiles[sl][i].FileNum {
+				return false
+			}
+		}
+	}
+	for i := range s.orderedIntervals {
+		a, b := &s.orderedIntervals[i], &other.orderedIntervals[i]
+		if intervalKeyCompare(s.cmp, a.startKey, b.startKey) != 0 || a.estimatedBytes != b.estimatedBytes {
+			return false
+		}
+	}
+	for i := range s.flushSplitUserKeys {
+		if s.cmp(s.flushSplitUserKeys[i], other.flushSplitUserKeys[i]) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
 // String produces a string containing useful debug information. Useful in test
 // code and debugging.
 func (s *L0Sublevels) String() string {
 	return s.describe(false)
 }
 
+// DataDrivenString returns the L0 files in the format consumed by the define
+// command of the l0_sublevels datadriven tests, with each sublevel specified
+// explicitly, from the highest to the lowest. The output can be pasted into a
+// test case to reproduce the state of L0, such as one observed in production.
+// User keys are written as is, so they must not contain whitespace or the
+// separators of the format.
+func (s *L0Sublevels) DataDrivenString() string {
+	var buf strings.Builder
+	formatKey := func(k InternalKey) string {
+		return fmt.Sprintf("%s.%s.%d", k.UserKey, k.Kind(), k.SeqNum())
+	}
+	for i := len(s.levelFiles) - 1; i >= 0; i-- {
+		fmt.Fprintf(&buf, "L0.%d\n", i)
+		for _, f := range s.levelFiles[i] {
+			fmt.Fprintf(&buf, "  %s:%s-%s size=%d", f.FileNum,
+				formatKey(f.Smallest), formatKey(f.Largest), f.Size)
+			if f.CreationTime != 0 {
+				fmt.Fprintf(&buf, " created=%d", f.CreationTime)
+			}
+			if f.IsCompacting() {
+				if f.IsIntraL0Compacting {
+					buf.WriteString(" intra_l0_compacting")
+				} else {
+					buf.WriteString(" base_compacting")
+				}
+			}
+			buf.WriteString("\n")
+		}
+	}
+	return buf.String()
+}
+
+// l0SublevelsJSONVersion is the version of the JSON encoding produced by
+// L0Sublevels.MarshalJSON. It must be incremented whenever the encoding changes
+// in a way that isn't backwards compatible.
+const l0SublevelsJSONVersion = 1
+
+type l0SublevelsJSON struct {
+	Version        int                  `json:"version"`
+	Sublevels      [][]l0FileJSON       `json:"sublevels"`
+	FlushSplitKeys []string             `json:"flushSplitKeys"`
+	Intervals      []l0FileIntervalJSON `json:"intervals"`
+}
+
+type l0FileJSON struct {
+	FileNum          base.FileNum `json:"fileNum"`
+	MinIntervalIndex int          `json:"minIntervalIndex"`
+	MaxIntervalIndex int          `json:"maxIntervalIndex"`
+}
+
+type l0FileIntervalJSON struct {
+	StartKey string `json:"startKey"`
+	// IsLargest is true if the interval starts immediately after StartKey,
+	// rather than at StartKey.
+	IsLargest      bool   `json:"isLargest,omitempty"`
+	FileCount      int    `json:"fileCount"`
+	EstimatedBytes uint64 `json:"estimatedBytes"`
+}
+
+// MarshalJSON implements json.Marshaler. It encodes the sublevels, from the
+// oldest to the newest, each as the list of its files with their interval
+// ranges, the flush split keys, and the intervals with their file counts and
+// estimated bytes. User keys are formatted with the FormatKey L0Sublevels was
+// constructed with. The encoding has a top-level "version" field, for tooling
+// consuming it offline.
+func (s *L0Sublevels) MarshalJSON() ([]byte, error) {
+	v := l0SublevelsJSON{
+		Version:        l0SublevelsJSONVersion,
+		Sublevels:      make([][]l0FileJSON, len(s.levelFiles)),
+		FlushSplitKeys: make([]string, len(s.flushSplitUserKeys)),
+		Intervals:      make([]l0FileIntervalJSON, len(s.orderedIntervals)),
+	}
+	for i, files := range s.levelFiles {
+		v.Sublevels[i] = make([]l0FileJSON, len(files))
+		for j, f := range files {
+			v.Sublevels[i][j] = l0FileJSON{
+				FileNum:          f.FileNum,
+				MinIntervalIndex: f.minIntervalIndex,
+				MaxIntervalIndex: f.maxIntervalIndex,
+			}
+		}
+	}
+	for i, key := range s.flushSplitUserKeys {
+		v.FlushSplitKeys[i] = fmt.Sprint(s.formatKey(key))
+	}
+	for i := range s.orderedIntervals {
+		interval := &s.orderedIntervals[i]
+		v.Intervals[i] = l0FileIntervalJSON{
+			StartKey:       fmt.Sprint(s.formatKey(interval.startKey.key)),
+			IsLargest:      interval.startKey.isLargest,
+			FileCount:      len(interval.files),
+			EstimatedBytes: interval.estimatedBytes,
+		}
+	}
+	return json.Marshal(v)
+}
+
+// dotEscaper escapes strings for use in quoted DOT IDs.
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// WriteDOT writes the sublevels to w as a graph in the DOT language, for
+// rendering with Graphviz. Every file is a node, labelled with its key range
+// and interval range, and files in the same sublevel have the same rank, with
+// sublevel 0 at the bottom. Nodes also have positions, honored by the neato
+// layout engine, placing each file horizontally at its interval range and
+// vertically at its sublevel. Edges connect each file to the files it overlaps
+// in the next sublevel. Files in base compactions are filled red, and files
+// in intra-L0 compactions are filled blue.
+func (s *L0Sublevels) WriteDOT(w io.Writer) error {
+	var buf strings.Builder
+	buf.WriteString("digraph L0 {\n  rankdir=BT;\n  node [shape=box];\n")
+	for sublevel, files := range s.levelFiles {
+		fmt.Fprintf(&buf, "  subgraph sublevel_%d {\n    rank=same;\n", sublevel)
+		for _, f := range files {
+			label := fmt.Sprintf("%s\\n%s-%s\\n[%d, %d]", f.FileNum,
+				dotEscaper.Replace(fmt.Sprint(s.formatKey(f.Smallest.UserKey))),
+				dotEscaper.Replace(fmt.Sprint(s.formatKey(f.Largest.UserKey))),
+				f.minIntervalIndex, f.maxIntervalIndex)
+			fmt.Fprintf(&buf, "    \"%s\" [label=\"%s\", pos=\"%.1f,%d!\"",
+				f.FileNum, label,
+				float64(f.minIntervalIndex+f.maxIntervalIndex)/2, sublevel)
+			if f.IsCompacting() {
+				color := "lightcoral"
+				if f.IsIntraL0Compacting {
+					color = "lightblue"
+				}
+				fmt.Fprintf(&buf, ", style=filled, fillcolor=%s", color)
+			}
+			buf.WriteString("];\n")
+		}
+		buf.WriteString("  }\n")
+	}
+	for sublevel := 0; sublevel+1 < len(s.levelFiles); sublevel++ {
+		for _, f := range s.levelFiles[sublevel] {
+			var lastAbove *FileMetadata
+			for i := f.minIntervalIndex; i <= f.maxIntervalIndex; i++ {
+				for _, above := range s.orderedIntervals[i].files {
+					// Files in the next sublevel overlapping f are visited in key
+					// order, so only the last one visited can be visited again.
+					if above.SubLevel != sublevel+1 || above == lastAbove {
+						continue
+					}
+					lastAbove = above
+					fmt.Fprintf(&buf, "  \"%s\" -> \"%s\";\n", f.FileNum, above.FileNum)
+				}
+			}
+		}
+	}
+	buf.WriteString("}\n")
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+// fileByteFraction returns the fraction of the estimated bytes of L0 within
+// the intervals the file f overlaps.
+func (s *L0Sublevels) fileByteFraction(f *FileMetadata) float64 {
+	var intervalsBytes uint64
+	for k := f.minIntervalIndex; k <= f.maxIntervalIndex; k++ {
+		intervalsBytes += s.orderedIntervals[k].estimatedBytes
+	}
+	return float64(intervalsBytes) / float64(s.fileBytes)
+}
+
+// WideFiles returns the files whose intervals hold more than
+// byteFractionThreshold of the estimated bytes of L0, in sublevel order, from
+// the oldest sublevel to the newest, and in increasing key order within a
+// sublevel. Such files span much of the data in L0, and many of them degrade
+// compaction selection, since every compaction overlapping one of them must
+// include it or wait for it. They are typically the product of flushes that
+// didn't split at the flush split keys. Returns nil if L0 is empty.
+func (s *L0Sublevels) WideFiles(byteFractionThreshold float64) []*FileMetadata {
+	if s.fileBytes == 0 {
+		return nil
+	}
+	var wide []*FileMetadata
+	for _, files := range s.levelFiles {
+		for _, f := range files {
+			if s.fileByteFraction(f) > byteFractionThreshold {
+				wide = append(wide, f)
+			}
+		}
+	}
+	return wide
+}
+
 func (s *L0Sublevels) describe(verbose bool) string {
 	var buf strings.Builder
 	fmt.Fprintf(&buf, "file count: %d, sublevels: %d, intervals: %d\nflush split keys(%d): [",
@@ -795,6 +1879,12 @@ func (s *L0Sublevels) describe(verbose bool) string {
 	fmt.Fprintln(&buf, "]")
 	numCompactingFiles := 0
 	for i := len(s.levelFiles) - 1; i >= 0; i-- {
+		if len(s.levelFiles[i]) == 0 {
+			// This should never happen, but describe is used for debugging
+			// precisely when things have gone wrong.
+			fmt.Fprintf(&buf, "0.%d: empty sublevel\n", i)
+			continue
+		}
 		maxIntervals := 0
 		sumIntervals := 0
 		var totalBytes uint64
@@ -817,54 +1907,59 @@ func (s *L0Sublevels) describe(verbose bool) string {
 			if verbose {
 				fmt.Fprintf(&buf, "\t%s\n", f)
 			}
-			if s.levelMetadata.Len() > 50 && intervals*3 > len(s.orderedIntervals) {
-				var intervalsBytes uint64
-				for k := f.minIntervalIndex; k <= f.maxIntervalIndex; k++ {
-					intervalsBytes += s.orderedIntervals[k].estimatedBytes
-				}
+			// Equivalent to intervals*3 > len(s.orderedIntervals), without the
+			// multiplication.
+			if s.levelMetadata.Len() > 50 && intervals > len(s.orderedIntervals)/3 {
 				fmt.Fprintf(&buf, "wide file: %d, [%d, %d], byte fraction: %f\n",
-					f.FileNum, f.minIntervalIndex, f.maxIntervalIndex,
-					float64(intervalsBytes)/float64(s.fileBytes))
+					f.FileNum, f.minIntervalIndex, f.maxIntervalIndex, s.fileByteFraction(f))
 			}
 		}
 	}
 
-	lastCompactingIntervalStart := -1
 	fmt.Fprintf(&buf, "compacting file count: %d, base compacting intervals: ", numCompactingFiles)
-	i := 0
-	foundBaseCompactingIntervals := false
-	for ; i < len(s.orderedIntervals); i++ {
-		interval := &s.orderedIntervals[i]
-		if len(interval.files) == 0 {
-			continue
-		}
-		if !interval.isBaseCompacting {
-			if lastCompactingIntervalStart != -1 {
-				if foundBaseCompactingIntervals {
-					buf.WriteString(", ")
-				}
-				fmt.Fprintf(&buf, "[%d, %d]", lastCompactingIntervalStart, i-1)
-				foundBaseCompactingIntervals = true
-			}
-			lastCompactingIntervalStart = -1
-		} else {
-			if lastCompactingIntervalStart == -1 {
-				lastCompactingIntervalStart = i
-			}
-		}
-	}
-	if lastCompactingIntervalStart != -1 {
-		if foundBaseCompactingIntervals {
+	ranges := s.BaseCompactingIntervalRanges()
+	for i, r := range ranges {
+		if i > 0 {
 			buf.WriteString(", ")
 		}
-		fmt.Fprintf(&buf, "[%d, %d]", lastCompactingIntervalStart, i-1)
-	} else if !foundBaseCompactingIntervals {
+		fmt.Fprintf(&buf, "[%d, %d]", r[0], r[1])
+	}
+	if len(ranges) == 0 {
 		fmt.Fprintf(&buf, "none")
 	}
 	fmt.Fprintln(&buf, "")
 	return buf.String()
 }
 
+// SublevelStats describes the files in one L0 sublevel.
+type SublevelStats struct {
+	// Files is the number of files in the sublevel.
+	Files int
+	// Bytes is the total size of the files in the sublevel.
+	Bytes uint64
+	// Compacting is the number of files in the sublevel that are compacting,
+	// whether in base or intra-L0 compactions.
+	Compacting int
+}
+
+// SublevelStats returns the stats of each sublevel, indexed by sublevel.
+// Comparing the compacting file counts of the oldest and youngest sublevels
+// reveals whether base or intra-L0 compactions dominate the current compaction
+// activity in L0.
+func (s *L0Sublevels) SublevelStats() []SublevelStats {
+	stats := make([]SublevelStats, len(s.levelFiles))
+	for i, files := range s.levelFiles {
+		stats[i].Files = len(files)
+		for _, f := range files {
+			stats[i].Bytes += f.Size
+			if f.IsCompacting() {
+				stats[i].Compacting++
+			}
+		}
+	}
+	return stats
+}
+
 // ReadAmplification returns the contribution of L0Sublevels to the read
 // amplification for any particular point key. It is the maximum height of any
 // tracked fileInterval. This is always less than or equal to the number of
@@ -881,29 +1976,559 @@ func (s *L0Sublevels) ReadAmplification() int {
 	return amp
 }
 
+// L0SublevelsSnapshot is an immutable view of the depth and compacting state
+// of the intervals of an L0Sublevels, as of the call to L0Sublevels.Snapshot.
+// Unlike L0Sublevels, whose compacting state is updated by
+// InitCompactingFileInfo and UpdateStateForStartedCompaction, its methods may
+// be called concurrently and without holding DB.mu, such as when computing
+// metrics.
+type L0SublevelsSnapshot struct {
+	intervals []l0SnapshotInterval
+}
+
+// l0SnapshotInterval holds the state of a fileInterval captured by
+// L0Sublevels.Snapshot.
+type l0SnapshotInterval struct {
+	fileCount           int
+	compactingFileCount int
+}
+
+// Snapshot returns an immutable snapshot of the depth and compacting state of
+// the intervals. It must be called under the same synchronization as
+// InitCompactingFileInfo, typically while holding DB.mu. Only the per-interval
+// counters are copied, so the snapshot is cheap relative to s.
+func (s *L0Sublevels) Snapshot() *L0SublevelsSnapshot {
+	snap := &L0SublevelsSnapshot{intervals: make([]l0SnapshotInterval, len(s.orderedIntervals))}
+	for i := range s.orderedIntervals {
+		interval := &s.orderedIntervals[i]
+		snap.intervals[i] = l0SnapshotInterval{
+			fileCount:           len(interval.files),
+			compactingFileCount: interval.compactingFileCount,
+		}
+	}
+	return snap
+}
+
+// ReadAmplification returns the read amplification of L0 as of the snapshot.
+// See L0Sublevels.ReadAmplification.
+func (snap *L0SublevelsSnapshot) ReadAmplification() int {
+	amp := 0
+	for i := range snap.intervals {
+		if amp < snap.intervals[i].fileCount {
+			amp = snap.intervals[i].fileCount
+		}
+	}
+	return amp
+}
+
+// MaxDepthAfterOngoingCompactions returns the stack depth of L0 after the
+// compactions ongoing as of the snapshot complete. See
+// L0Sublevels.MaxDepthAfterOngoingCompactions.
+func (snap *L0SublevelsSnapshot) MaxDepthAfterOngoingCompactions() int {
+	depth := 0
+	for i := range snap.intervals {
+		interval := &snap.intervals[i]
+		if d := interval.fileCount - interval.compactingFileCount; depth < d {
+			depth = d
+		}
+	}
+	return depth
+}
+
+// ReadAmplificationByInterval returns the number of files in each interval, by
+// interval index. Its maximum is ReadAmplification. Interval indices can be
+// mapped to user keys through IntervalBoundaryKeys.
+func (s *L0Sublevels) ReadAmplificationByInterval() []int {
+	amps := make([]int, len(s.orderedIntervals))
+	for i := range s.orderedIntervals {
+		amps[i] = len(s.orderedIntervals[i].files)
+	}
+	return amps
+}
+
+// DepthHistogram returns the number of intervals with each number of files,
+// indexed by the number of files, from 0 up to ReadAmplification. Unlike
+// ReadAmplification, this distinguishes a single deep region of the key space
+// from a uniformly deep L0. Intervals with no files, including the last
+// interval, which starts at the largest key in L0, are counted at index 0.
+func (s *L0Sublevels) DepthHistogram() []int {
+	hist := make([]int, s.ReadAmplification()+1)
+	for i := range s.orderedIntervals {
+		hist[len(s.orderedIntervals[i].files)]++
+	}
+	return hist
+}
+
+// HasIntervalDeeperThan returns true if any interval has more than depth
+// files, i.e. if ReadAmplification exceeds depth. It stops at the first such
+// interval, so it is cheaper than ReadAmplification for checking a threshold.
+func (s *L0Sublevels) HasIntervalDeeperThan(depth int) bool {
+	for i := range s.orderedIntervals {
+		if len(s.orderedIntervals[i].files) > depth {
+			return true
+		}
+	}
+	return false
+}
+
+// MinPossibleSublevels returns the minimum number of sublevels the current
+// files could be arranged in, which is the maximum number of files overlapping
+// any single key. Since every file in an interval overlaps every key in it,
+// this is the same as ReadAmplification, but it can be lower than the number
+// of sublevels, as sublevels are assigned from chains of overlapping files.
+// The difference bounds how much intra-L0 compactions of files can reduce the
+// sublevel count; only base compactions can reduce it further.
+func (s *L0Sublevels) MinPossibleSublevels() int {
+	return s.ReadAmplification()
+}
+
+// WeightedReadAmplification returns the mean depth of the intervals, weighted
+// by the width of each interval's key span as returned by
+// opts.KeySpaceWidth. Unlike ReadAmplification, which is the maximum depth of
+// any interval and can be dominated by a narrow interval, this is proportional
+// to the cost of scanning the key space. Without opts.KeySpaceWidth, intervals
+// are weighted equally. Returns 0 if L0 is empty.
+func (s *L0Sublevels) WeightedReadAmplification() float64 {
+	var weightedDepth, totalWidth float64
+	// The last interval starts at the largest key of L0 and contains no files.
+	for i := 0; i < len(s.orderedIntervals)-1; i++ {
+		width := 1.0
+		if s.opts.KeySpaceWidth != nil {
+			width = s.opts.KeySpaceWidth(s.orderedIntervals[i].startKey.key, s.orderedIntervals[i+1].startKey.key)
+		}
+		weightedDepth += width * float64(len(s.orderedIntervals[i].files))
+		totalWidth += width
+	}
+	if totalWidth == 0 {
+		return 0
+	}
+	return weightedDepth / totalWidth
+}
+
+// ReadAmplificationAfter returns the read amplification of L0, as computed by
+// ReadAmplification, that would result from applying the specified picked
+// compaction: its files are treated as removed from L0, and for intra-L0
+// compactions, a single output file spanning the compaction's intervals is
+// treated as added. This allows comparing the global effect of candidate
+// compactions, unlike their seed interval stack depth reductions which are
+// local to each candidate. The receiver is not modified.
+func (s *L0Sublevels) ReadAmplificationAfter(c *L0CompactionFiles) int {
+	// delta[i] - delta[i-1] is the change in the file count of interval i.
+	delta := make([]int, len(s.orderedIntervals)+1)
+	for _, f := range c.Files {
+		delta[f.minIntervalIndex]--
+		delta[f.maxIntervalIndex+1]++
+	}
+	if c.isIntraL0 && len(c.Files) > 0 {
+		delta[c.minIntervalIndex]++
+		delta[c.maxIntervalIndex+1]--
+	}
+	amp := 0
+	change := 0
+	for i := range s.orderedIntervals {
+		change += delta[i]
+		if fileCount := len(s.orderedIntervals[i].files) + change; amp < fileCount {
+			amp = fileCount
+		}
+	}
+	return amp
+}
+
+// FileIntervals returns the indices of the intervals overlapped by the
+// specified file, in increasing order. A file always overlaps a contiguous
+// range of intervals, so these are the indices from its smallest to its
+// largest interval, inclusive. The file must be one of the L0 files of the
+// receiver.
+func (s *L0Sublevels) FileIntervals(f *FileMetadata) []int {
+	indices := make([]int, 0, f.maxIntervalIndex-f.minIntervalIndex+1)
+	for i := f.minIntervalIndex; i <= f.maxIntervalIndex; i++ {
+		indices = append(indices, i)
+	}
+	return indices
+}
+
+// FileAtSublevelForKey returns the file in the specified sublevel that contains
+// the specified user key within its bounds, or nil if there is no such file.
+// Files in a sublevel don't overlap, so there is at most one. The file is found
+// by binary search over the interval indices of the sublevel's files, rather
+// than comparing keys against every file. Returns nil if the sublevel is out of
+// range.
+func (s *L0Sublevels) FileAtSublevelForKey(sublevel int, key []byte) *FileMetadata {
+	if sublevel < 0 || sublevel >= len(s.levelFiles) {
+		return nil
+	}
+	ik := intervalKey{key: key}
+	// The index of the last interval starting at or before key.
+	index := sort.Search(len(s.orderedIntervals), func(i int) bool {
+		return intervalKeyCompare(s.cmp, s.orderedIntervals[i].startKey, ik) > 0
+	}) - 1
+	if index < 0 {
+		return nil
+	}
+	files := s.levelFiles[sublevel]
+	i := sort.Search(len(files), func(i int) bool {
+		return files[i].maxIntervalIndex >= index
+	})
+	if i == len(files) || files[i].minIntervalIndex > index {
+		return nil
+	}
+	return files[i]
+}
+
+// UnionIntervalRange returns the smallest and largest interval indices
+// overlapped by any of the specified files, which must be L0 files of the
+// receiver. These are the interval bounds that an L0CompactionFiles made up of
+// the files would have. If files is empty, min is greater than max.
+func (s *L0Sublevels) UnionIntervalRange(files []*FileMetadata) (min, max int) {
+	min, max = math.MaxInt32, -1
+	for _, f := range files {
+		if f.minIntervalIndex < min {
+			min = f.minIntervalIndex
+		}
+		if f.maxIntervalIndex > max {
+			max = f.maxIntervalIndex
+		}
+	}
+	return min, max
+}
+
+// IntervalsForSortedKeys returns, for each of the specified user keys, the
+// index of the interval containing it: the last interval with a start key
+// less than or equal to the key. Keys smaller than the start key of the first
+// interval are assigned -1. The keys must be sorted in increasing order, which
+// lets them be assigned in a single pass over the intervals, in
+// O(len(keys) + number of intervals) time.
+func (s *L0Sublevels) IntervalsForSortedKeys(keys [][]byte) []int {
+	indices := make([]int, len(keys))
+	i := -1
+	for j, key := range keys {
+		ik := intervalKey{key: key, isLargest: false}
+		for i+1 < len(s.orderedIntervals) &&
+			intervalKeyCompare(s.cmp, s.orderedIntervals[i+1].startKey, ik) <= 0 {
+			i++
+		}
+		indices[j] = i
+	}
+	return indices
+}
+
+// IntervalCompactingCount returns the number of files in the interval with the
+// specified index that are compacting. The interval's depth, as seen by the
+// compaction pickers, is the number of files in the interval minus this count.
+// The index must be in [0, len(IntervalBoundaryKeys())).
+func (s *L0Sublevels) IntervalCompactingCount(index int) int {
+	return s.orderedIntervals[index].compactingFileCount
+}
+
+// NonCompactingIntervalGaps returns the maximal runs of adjacent intervals that
+// are not base compacting and have at least minDepth non-compacting files, as
+// [start, end] pairs of interval indices, inclusive on both ends, in increasing
+// order. These are the intervals that PickBaseCompaction considers as seeds.
+func (s *L0Sublevels) NonCompactingIntervalGaps(minDepth int) [][2]int {
+	var gaps [][2]int
+	inGap := false
+	for i := range s.orderedIntervals {
+		interval := &s.orderedIntervals[i]
+		depth := len(interval.files) - interval.compactingFileCount
+		if interval.isBaseCompacting || depth < minDepth {
+			inGap = false
+			continue
+		}
+		if inGap {
+			gaps[len(gaps)-1][1] = i
+		} else {
+			gaps = append(gaps, [2]int{i, i})
+			inGap = true
+		}
+	}
+	return gaps
+}
+
+// LongestNonCompactingRun returns the longest run of adjacent intervals that
+// contain no compacting files and are not base compacting, as a [start, end]
+// pair of interval indices, inclusive on both ends. This is the region most
+// free to accept a new compaction without conflicting with ongoing ones. The
+// first such run is returned if there are several, and (-1, -1) if there are
+// none.
+func (s *L0Sublevels) LongestNonCompactingRun() (start, end int) {
+	start, end = -1, -1
+	runStart := -1
+	for i := range s.orderedIntervals {
+		interval := &s.orderedIntervals[i]
+		if interval.compactingFileCount > 0 || interval.isBaseCompacting {
+			runStart = -1
+			continue
+		}
+		if runStart == -1 {
+			runStart = i
+		}
+		if start == -1 || i-runStart > end-start {
+			start, end = runStart, i
+		}
+	}
+	return start, end
+}
+
+// BaseCompactingIntervalRanges returns the maximal runs of base compacting
+// intervals, as [start, end] pairs of interval indices, inclusive on both ends,
+// in increasing order. These are the ranges String prints as the base
+// compacting intervals. Intervals with no files are never base compacting, and
+// don't start a run, but don't interrupt one either: a run extends over the
+// intervals with no files following it, up to the next interval that has
+// files and isn't base compacting, or up to the last interval.
+func (s *L0Sublevels) BaseCompactingIntervalRanges() [][2]int {
+	var ranges [][2]int
+	start := -1
+	for i := range s.orderedIntervals {
+		interval := &s.orderedIntervals[i]
+		if len(interval.files) == 0 {
+			continue
+		}
+		if !interval.isBaseCompacting {
+			if start != -1 {
+				ranges = append(ranges, [2]int{start, i - 1})
+			}
+			start = -1
+			continue
+		}
+		if start == -1 {
+			start = i
+		}
+	}
+	if start != -1 {
+		ranges = append(ranges, [2]int{start, len(s.orderedIntervals) - 1})
+	}
+	return ranges
+}
+
+// CompactionSpreadScore returns a measure of how clustered the ongoing base
+// compactions are along the key space. The intervals that aren't base
+// compacting form gaps before, between and after the ranges of base compacting
+// intervals, and the score is the variance of the gap sizes, in intervals,
+// divided by the square of their mean. It is 0 when base compactions are
+// evenly spread, or when there are none, and grows as they cluster together,
+// which leaves less room for concurrent compactions elsewhere.
+func (s *L0Sublevels) CompactionSpreadScore() float64 {
+	ranges := s.BaseCompactingIntervalRanges()
+	if len(ranges) == 0 {
+		return 0
+	}
+	// The last interval starts at the largest key of L0, and has no files.
+	lastIndex := len(s.orderedIntervals) - 2
+	gaps := make([]float64, 0, len(ranges)+1)
+	prevEnd := -1
+	for _, r := range ranges {
+		gaps = append(gaps, float64(r[0]-prevEnd-1))
+		// Intervals with no files at the end of a run are not compacting;
+		// count them towards the following gap.
+		end := r[1]
+		for end > r[0] && len(s.orderedIntervals[end].files) == 0 {
+			end--
+		}
+		prevEnd = end
+	}
+	gaps = append(gaps, float64(lastIndex-prevEnd))
+	var mean float64
+	for _, gap := range gaps {
+		mean += gap
+	}
+	mean /= float64(len(gaps))
+	if mean == 0 {
+		return 0
+	}
+	var variance float64
+	for _, gap := range gaps {
+		variance += (gap - mean) * (gap - mean)
+	}
+	variance /= float64(len(gaps))
+	return variance / (mean * mean)
+}
+
+// MinPickableDepth returns the largest minCompactionDepth for which
+// PickBaseCompaction may pick a compaction: the largest number of
+// non-compacting files in any interval that is not base compacting. Returns 0
+// if there is no such interval. A pick with this depth can still fail, for
+// instance if the seed interval's compaction would include compacting Lbase
+// files, so this is an upper bound that saves probing PickBaseCompaction with
+// decreasing depths.
+func (s *L0Sublevels) MinPickableDepth() int {
+	maxDepth := 0
+	for i := range s.orderedIntervals {
+		interval := &s.orderedIntervals[i]
+		if interval.isBaseCompacting {
+			continue
+		}
+		if depth := len(interval.files) - interval.compactingFileCount; depth > maxDepth {
+			maxDepth = depth
+		}
+	}
+	return maxDepth
+}
+
+// IsFullyCompacting returns true if every L0 file is compacting, in which case
+// no L0 compaction can be picked. Also returns true if there are no L0 files.
+func (s *L0Sublevels) IsFullyCompacting() bool {
+	iter := s.levelMetadata.Iter()
+	for f := iter.First(); f != nil; f = iter.Next() {
+		if !f.IsCompacting() {
+			return false
+		}
+	}
+	return true
+}
+
+// EstimateReadAmpIncrease returns an estimate of how much the read
+// amplification of L0, as computed by ReadAmplification, would increase if the
+// specified files were ingested into L0. The files must not overlap each
+// other, as is required of ingested files. Each file is assumed to be placed
+// above all existing files in the intervals it overlaps. Intervals that a file
+// only partially overlaps are counted as fully overlapped, so the estimate
+// errs on the high side.
+func (s *L0Sublevels) EstimateReadAmpIncrease(files []*FileMetadata) int {
+	if len(files) == 0 {
+		return 0
+	}
+	if len(s.orderedIntervals) == 0 {
+		return 1
+	}
+	overlapped := newBitSet(len(s.orderedIntervals))
+	for _, f := range files {
+		start, end := s.intervalRange(f.Smallest.UserKey, f.Largest.UserKey)
+		overlapped.markBits(start, end)
+	}
+	before := 0
+	after := 0
+	for i := range s.orderedIntervals {
+		fileCount := len(s.orderedIntervals[i].files)
+		if before < fileCount {
+			before = fileCount
+		}
+		if overlapped.Contains(i) {
+			fileCount++
+		}
+		if after < fileCount {
+			after = fileCount
+		}
+	}
+	return after - before
+}
+
+// IntervalBoundaryKeys returns the start user key of each interval, in
+// increasing interval index order. Callers that classify many keys against
+// intervals may binary search over the returned slice themselves. An interval
+// that starts immediately after a file's inclusive largest key has the same
+// user key as the preceding interval, so consecutive keys may be equal. The
+// returned keys must not be modified.
+func (s *L0Sublevels) IntervalBoundaryKeys() [][]byte {
+	keys := make([][]byte, len(s.orderedIntervals))
+	for i := range s.orderedIntervals {
+		keys[i] = s.orderedIntervals[i].startKey.key
+	}
+	return keys
+}
+
+// IntervalBounds returns the user keys bounding the interval with the
+// specified index, or false if there is no such interval. The interval
+// normally spans [start, end). However, interval bounds derived from the
+// inclusive largest key of a file stand for the immediate successor of that
+// key: if the interval starts right after a file's largest key, start is
+// exclusive, and if the next interval does, end is inclusive. For instance,
+// the interval between a file a-c and a file starting at e is (c, e), and a
+// file b-d not overlapping other files is covered by the interval [b, d]. end
+// is nil for the last interval, which is unbounded and contains no files.
+func (s *L0Sublevels) IntervalBounds(index int) (start, end []byte, ok bool) {
+	if index < 0 || index >= len(s.orderedIntervals) {
+		return nil, nil, false
+	}
+	start = s.orderedIntervals[index].startKey.key
+	if index+1 < len(s.orderedIntervals) {
+		end = s.orderedIntervals[index+1].startKey.key
+	}
+	return start, end, true
+}
+
+// OccupancyMatrix returns, for each sublevel and interval, whether a file in
+// that sublevel overlaps that interval. The returned matrix is indexed by
+// [sublevel][interval]. It requires O(sublevels*intervals) memory and is
+// meant for analysis tooling, not for use in hot paths.
+func (s *L0Sublevels) OccupancyMatrix() [][]bool {
+	m := make([][]bool, len(s.levelFiles))
+	for sl, files := range s.levelFiles {
+		m[sl] = make([]bool, len(s.orderedIntervals))
+		for _, f := range files {
+			for i := f.minIntervalIndex; i <= f.maxIntervalIndex; i++ {
+				m[sl][i] = true
+			}
+		}
+	}
+	return m
+}
+
 // UserKeyRange encodes a key range in user key space. A UserKeyRange's Start
 // and End boundaries are both inclusive.
 type UserKeyRange struct {
 	Start, End []byte
 }
 
-// InUseKeyRanges returns the merged table bounds of L0 files overlapping the
-// provided user key range. The returned key ranges are sorted and
-// nonoverlapping.
-func (s *L0Sublevels) InUseKeyRanges(smallest, largest []byte) []UserKeyRange {
+// intervalRange returns the range of interval indices [start, end) that
+// overlap the user key range [smallest, largest], inclusive on both ends.
+func (s *L0Sublevels) intervalRange(smallest, largest []byte) (start, end int) {
 	// Binary search to find the provided keys within the intervals.
 	startIK := intervalKey{key: smallest, isLargest: false}
 	endIK := intervalKey{key: largest, isLargest: true}
-	start := sort.Search(len(s.orderedIntervals), func(i int) bool {
+	start = sort.Search(len(s.orderedIntervals), func(i int) bool {
 		return intervalKeyCompare(s.cmp, s.orderedIntervals[i].startKey, startIK) > 0
 	})
 	if start > 0 {
 		// Back up to the first interval with a start key <= startIK.
 		start--
 	}
-	end := sort.Search(len(s.orderedIntervals), func(i int) bool {
+	end = sort.Search(len(s.orderedIntervals), func(i int) bool {
 		return intervalKeyCompare(s.cmp, s.orderedIntervals[i].startKey, endIK) > 0
 	})
+	return start, end
+}
+
+// WouldAddSublevel returns true if a new file with the specified user key
+// bounds, added to L0 now, would be placed in a sublevel that does not exist
+// yet, increasing the number of sublevels. The new file is assumed to be newer
+// than all existing L0 files, as is the case for flushed files, so it is
+// stacked above every file in the intervals it overlaps.
+func (s *L0Sublevels) WouldAddSublevel(smallest, largest []byte) bool {
+	start, end := s.intervalRange(smallest, largest)
+	subLevel := 0
+	for i := start; i < end; i++ {
+		files := s.orderedIntervals[i].files
+		if len(files) > 0 && subLevel <= files[len(files)-1].SubLevel {
+			subLevel = files[len(files)-1].SubLevel + 1
+		}
+	}
+	return subLevel >= len(s.Levels)
+}
+
+// ShallowestIntervalInRange returns the index and depth of the interval with
+// the fewest files among the intervals overlapping the user key range
+// [start, end], inclusive on both ends. Ties are broken in favor of the
+// interval with the smallest keys. The depth counts all files in the interval,
+// including compacting ones, since they continue to contribute to read
+// amplification until their compaction completes. Returns an index of -1 if
+// L0 is empty.
+func (s *L0Sublevels) ShallowestIntervalInRange(start, end []byte) (index int, depth int) {
+	startIndex, endIndex := s.intervalRange(start, end)
+	index = -1
+	for i := startIndex; i < endIndex; i++ {
+		if d := len(s.orderedIntervals[i].files); index == -1 || d < depth {
+			index, depth = i, d
+		}
+	}
+	return index, depth
+}
+
+// InUseKeyRanges returns the merged table bounds of L0 files overlapping the
+// provided user key range. The returned key ranges are sorted and
+// nonoverlapping.
+func (s *L0Sublevels) InUseKeyRanges(smallest, largest []byte) []UserKeyRange {
+	start, end := s.intervalRange(smallest, largest)
 
 	var keyRanges []UserKeyRange
 	var curr *UserKeyRange
@@ -947,6 +2572,70 @@ func (s *L0Sublevels) InUseKeyRanges(smallest, largest []byte) []UserKeyRange {
 	return keyRanges
 }
 
+// FilesOverlapping returns the L0 files overlapping the user key range
+// [start, end), exclusive of end. Files are returned once each, in sublevel
+// order, from the oldest sublevel to the newest, and in increasing key order
+// within a sublevel. Returns nil if no files overlap the range.
+func (s *L0Sublevels) FilesOverlapping(start, end []byte) []*FileMetadata {
+	if s.cmp(start, end) >= 0 {
+		return nil
+	}
+	startIK := intervalKey{key: start}
+	endIK := intervalKey{key: end}
+	// The index of the last interval starting at or before start.
+	startIndex := sort.Search(len(s.orderedIntervals), func(i int) bool {
+		return intervalKeyCompare(s.cmp, s.orderedIntervals[i].startKey, startIK) > 0
+	})
+	if startIndex > 0 {
+		startIndex--
+	}
+	// The index of the first interval starting at or after end.
+	endIndex := sort.Search(len(s.orderedIntervals), func(i int) bool {
+		return intervalKeyCompare(s.cmp, s.orderedIntervals[i].startKey, endIK) >= 0
+	})
+
+	var files []*FileMetadata
+	seen := newBitSet(s.levelMetadata.Len())
+	for i := startIndex; i < endIndex; i++ {
+		for _, f := range s.orderedIntervals[i].files {
+			if seen.Contains(f.L0Index) {
+				continue
+			}
+			seen.markBit(f.L0Index)
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].SubLevel != files[j].SubLevel {
+			return files[i].SubLevel < files[j].SubLevel
+		}
+		return files[i].minIntervalIndex < files[j].minIntervalIndex
+	})
+	return files
+}
+
+// FileIntervalRange returns the range of intervals, inclusive on both ends, that
+// the L0 file f spans, as computed when f was added to the sublevels. This
+// saves callers from searching the interval keys again. ok is false if f is
+// not part of these sublevels, for instance if f is a stale pointer to a file
+// that has since been compacted.
+func (s *L0Sublevels) FileIntervalRange(f *FileMetadata) (min, max int, ok bool) {
+	if f.L0Index < 0 || f.L0Index >= s.levelMetadata.Len() ||
+		f.SubLevel < 0 || f.SubLevel >= len(s.levelFiles) {
+		return 0, 0, false
+	}
+	// The files in a sublevel don't overlap, so f is the first file in its
+	// sublevel that ends at or after the start of f.
+	files := s.levelFiles[f.SubLevel]
+	i := sort.Search(len(files), func(i int) bool {
+		return files[i].maxIntervalIndex >= f.minIntervalIndex
+	})
+	if i == len(files) || files[i] != f {
+		return 0, 0, false
+	}
+	return f.minIntervalIndex, f.maxIntervalIndex, true
+}
+
 // FlushSplitKeys returns a slice of user keys to split flushes at.
 // Used by flushes to avoid writing sstables that straddle these split keys.
 // These should be interpreted as the keys to start the next sstable (not the
@@ -957,6 +2646,185 @@ func (s *L0Sublevels) FlushSplitKeys() [][]byte {
 	return s.flushSplitUserKeys
 }
 
+// FlushSplitKeysWithBytes returns the flush split keys, like FlushSplitKeys,
+// along with the estimated bytes of L0 preceding each split key: the bytes
+// between the previous split key, or the start of the key space, and the
+// split key. These are the bytes the split keys were placed by, and can be
+// used by flushes to size output sstables, such as to avoid emitting tiny
+// sstables between closely spaced split keys. The returned slices must not be
+// modified.
+func (s *L0Sublevels) FlushSplitKeysWithBytes() ([][]byte, []uint64) {
+	return s.flushSplitUserKeys, s.flushSplitBytes
+}
+
+// FlushSplitsAreStale returns true if the L0 files, their sizes or their
+// sublevels have changed since the flush split keys were computed, such as
+// when the sublevels of files were changed without going through AddL0Files.
+// The flush split keys may then no longer partition the bytes in L0 well, and
+// should be recomputed before being used for flushes.
+func (s *L0Sublevels) FlushSplitsAreStale() bool {
+	return s.filesFingerprint() != s.flushSplitFingerprint
+}
+
+// filesFingerprint returns an FNV-1a style hash of the file numbers, sizes and
+// sublevels of the L0 files.
+func (s *L0Sublevels) filesFingerprint() uint64 {
+	const prime = 1099511628211
+	h := uint64(14695981039346656037)
+	iter := s.levelMetadata.Iter()
+	for f := iter.First(); f != nil; f = iter.Next() {
+		for _, v := range [3]uint64{uint64(f.FileNum), f.Size, uint64(f.SubLevel)} {
+			h = (h ^ v) * prime
+		}
+	}
+	return h
+}
+
+// FlushSplitKeyInterval returns the index of the first interval whose start
+// key is the nth flush split key, relating the split schedule returned by
+// FlushSplitKeys to interval indices. It returns -1 if n is out of range.
+func (s *L0Sublevels) FlushSplitKeyInterval(n int) int {
+	if n < 0 || n >= len(s.flushSplitUserKeys) {
+		return -1
+	}
+	splitIK := intervalKey{key: s.flushSplitUserKeys[n], isLargest: false}
+	index := sort.Search(len(s.orderedIntervals), func(i int) bool {
+		return intervalKeyCompare(s.cmp, s.orderedIntervals[i].startKey, splitIK) >= 0
+	})
+	if index == len(s.orderedIntervals) ||
+		s.cmp(s.orderedIntervals[index].startKey.key, splitIK.key) != 0 {
+		return -1
+	}
+	return index
+}
+
+// CumulativeIntervalBytes returns the running sum of the estimated bytes of
+// each interval, by interval index. This is the curve that flush split keys
+// are computed from: a split key is placed at the start of an interval once
+// the bytes accumulated since the previous split key exceed the flush split
+// threshold, scaled by the number of sublevels.
+func (s *L0Sublevels) CumulativeIntervalBytes() []uint64 {
+	cumulative := make([]uint64, len(s.orderedIntervals))
+	var sum uint64
+	for i := range s.orderedIntervals {
+		sum += s.orderedIntervals[i].estimatedBytes
+		cumulative[i] = sum
+	}
+	return cumulative
+}
+
+// FilesStraddlingSplitKeys returns the files that contain keys on both sides
+// of some flush split key, i.e. files that contain keys less than the split
+// key as well as the split key itself or keys beyond it. Such files were
+// typically flushed before the current split keys were computed, and are
+// candidates for rewriting to restore the invariant that flushed files do not
+// straddle split keys.
+func (s *L0Sublevels) FilesStraddlingSplitKeys() []*FileMetadata {
+	var files []*FileMetadata
+	seen := newBitSet(s.levelMetadata.Len())
+	for _, key := range s.flushSplitUserKeys {
+		splitIK := intervalKey{key: key, isLargest: false}
+		// Files that start before the split key have minIntervalIndex < start.
+		start := sort.Search(len(s.orderedIntervals), func(i int) bool {
+			return intervalKeyCompare(s.cmp, s.orderedIntervals[i].startKey, splitIK) >= 0
+		})
+		// Files that contain the split key or beyond end at an interval at or
+		// beyond end, i.e. have maxIntervalIndex >= end-1.
+		end := sort.Search(len(s.orderedIntervals), func(i int) bool {
+			return intervalKeyCompare(s.cmp, s.orderedIntervals[i].startKey, splitIK) > 0
+		})
+		if start == 0 {
+			continue
+		}
+		// All straddling files overlap the interval right before the split key.
+		for _, f := range s.orderedIntervals[start-1].files {
+			if f.maxIntervalIndex >= end-1 && !seen.Contains(f.L0Index) {
+				seen.markBit(f.L0Index)
+				files = append(files, f)
+			}
+		}
+	}
+	return files
+}
+
+// SeqNumOverlaps returns the pairs of files that overlap in key space and
+// whose sequence number ranges overlap, as [2]*FileMetadata{older, newer}
+// where older is in the lower sublevel. Such files are permitted in L0, as
+// sublevels are assigned by LargestSeqNum, but an intra-L0 compaction must be
+// careful not to move the sequence numbers of the older file above those of
+// the newer one. This is a diagnostic for validating that assumption, and runs
+// in time quadratic in the depth of each interval. Pairs are ordered by the
+// L0Index of the older file, then that of the newer file.
+func (s *L0Sublevels) SeqNumOverlaps() [][2]*FileMetadata {
+	type pairKey struct{ older, newer int }
+	seen := make(map[pairKey]struct{})
+	var pairs [][2]*FileMetadata
+	for i := range s.orderedIntervals {
+		files := s.orderedIntervals[i].files
+		for j := range files {
+			for k := j + 1; k < len(files); k++ {
+				older, newer := files[j], files[k]
+				if older.LargestSeqNum < newer.SmallestSeqNum {
+					continue
+				}
+				key := pairKey{older: older.L0Index, newer: newer.L0Index}
+				if _, ok := seen[key]; ok {
+					continue
+				}
+				seen[key] = struct{}{}
+				pairs = append(pairs, [2]*FileMetadata{older, newer})
+			}
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0].L0Index != pairs[j][0].L0Index {
+			return pairs[i][0].L0Index < pairs[j][0].L0Index
+		}
+		return pairs[i][1].L0Index < pairs[j][1].L0Index
+	})
+	return pairs
+}
+
+// PendingCompactionBytes returns the bytes of the L0 files that are not yet
+// compacting and would need to be compacted to clear the stack down to a
+// depth of targetDepth files in every interval, after the ongoing compactions
+// complete. It can be used to pace writes and ingestions as L0 debt grows,
+// with targetDepth set to the L0 compaction threshold. A targetDepth below
+// zero is treated as zero.
+//
+// In an interval with n files, of which c are compacting, the n-c-targetDepth
+// oldest non-compacting files need to be compacted, since base compactions
+// drain L0 from its oldest sublevel upwards. Files spanning multiple intervals
+// are counted once: the files needing compaction are collected across all
+// intervals first, and then their sizes are added up. Since a compaction
+// rewrites whole files, this counts the bytes of a file even if only part of
+// its key range is too deep.
+func (s *L0Sublevels) PendingCompactionBytes(targetDepth int) uint64 {
+	if targetDepth < 0 {
+		targetDepth = 0
+	}
+	pendingFiles := newBitSet(s.levelMetadata.Len())
+	var pending uint64
+	for i := range s.orderedIntervals {
+		interval := &s.orderedIntervals[i]
+		excess := len(interval.files) - interval.compactingFileCount - targetDepth
+		for _, f := range interval.files {
+			if excess <= 0 {
+				break
+			}
+			if f.IsCompacting() {
+				continue
+			}
+			excess--
+			if !pendingFiles.Contains(f.L0Index) {
+				pendingFiles.markBit(f.L0Index)
+				pending += f.Size
+			}
+		}
+	}
+	return pending
+}
+
 // MaxDepthAfterOngoingCompactions returns an estimate of maximum depth of
 // sublevels after all ongoing compactions run to completion. Used by compaction
 // picker to decide compaction score for L0. There is no scoring for intra-L0
@@ -1047,7 +2915,7 @@ func (s *L0Sublevels) checkCompaction(c *L0CompactionFiles) error {
 					f.FileNum, c.earliestUnflushedSeqNum, f.SmallestSeqNum,
 					f.LargestSeqNum)
 			}
-			if !includedFiles[f.L0Index] {
+			if !includedFiles.Contains(f.L0Index) {
 				var buf strings.Builder
 				fmt.Fprintf(&buf, "bug %t, seed interval: %d: level %d, sl index %d, f.index %d, min %d, max %d, pre-min %d, pre-max %d, f.min %d, f.max %d, filenum: %d, isCompacting: %t\n%s\n",
 					c.isIntraL0, c.seedInterval, level, index, f.L0Index, min, max, c.preExtensionMinInterval, c.preExtensionMaxInterval,
@@ -1077,6 +2945,7 @@ func (s *L0Sublevels) checkCompaction(c *L0CompactionFiles) error {
 // and IsIntraL0Compacting fields are already set on all FileMetadatas passed
 // in.
 func (s *L0Sublevels) UpdateStateForStartedCompaction(inputs []LevelSlice, isBase bool) error {
+	s.generation++
 	minIntervalIndex := -1
 	maxIntervalIndex := 0
 	for i := range inputs {
@@ -1106,6 +2975,30 @@ func (s *L0Sublevels) UpdateStateForStartedCompaction(inputs []LevelSlice, isBas
 	return nil
 }
 
+// MarkCompacting marks the files of the specified picked compaction as
+// compacting, and updates internal L0Sublevels state for the started
+// compaction, in one step. Unlike UpdateStateForStartedCompaction, the caller
+// does not need to set the compaction state of the files beforehand, so the
+// files' compaction state and the per-interval compacting counts never
+// disagree. Lbase files of a base compaction must still be marked by the
+// caller. Returns an error without modifying any state if a file in the
+// compaction is already compacting.
+//
+// Requires DB.mu to be held.
+func (s *L0Sublevels) MarkCompacting(c *L0CompactionFiles) error {
+	for _, f := range c.Files {
+		if f.IsCompacting() {
+			return errors.Errorf("pebble: file %s is already compacting", f.FileNum)
+		}
+	}
+	for _, f := range c.Files {
+		f.CompactionState = CompactionStateCompacting
+		f.IsIntraL0Compacting = c.isIntraL0
+	}
+	return s.UpdateStateForStartedCompaction(
+		[]LevelSlice{NewLevelSliceSpecificOrder(c.Files)}, !c.isIntraL0)
+}
+
 // L0CompactionFiles represents a candidate set of L0 files for compaction.
 // Also referred to as "lcf". Contains state information useful
 // for generating the compaction (such as Files), as well as for picking
@@ -1114,6 +3007,7 @@ func (s *L0Sublevels) UpdateStateForStartedCompaction(inputs []LevelSlice, isBas
 type L0CompactionFiles struct {
 	Files []*FileMetadata
 
+	// FilesIncluded contains the L0Index of every file in Files.
 	FilesIncluded bitSet
 	// A "seed interval" is an interval with a high stack depth that was chosen
 	// to bootstrap this compaction candidate. seedIntervalStackDepthReduction
@@ -1140,15 +3034,331 @@ type L0CompactionFiles struct {
 	isIntraL0               bool
 	earliestUnflushedSeqNum uint64
 
+	// The number of times a file was examined while building and extending
+	// this candidate. See FilesExamined.
+	filesExamined int
+
+	// The compacting or excluded files that stopped this candidate from
+	// growing deeper.
+	// See BlockingFiles.
+	blockingFiles []*FileMetadata
+
+	// onFileAdded, if non-nil, is called by addFileFor for each file added to
+	// this candidate. See L0PickOptions.OnFileAdded.
+	onFileAdded func(f *FileMetadata, reason FileAddedReason)
+	// excluded, if non-nil, holds the L0Index of the files this candidate must
+	// not include. See L0PickOptions.Excluded.
+	excluded bitSet
+
 	// For debugging purposes only. Used in checkCompaction().
 	preExtensionMinInterval int
 	preExtensionMaxInterval int
 	filesAdded              []*FileMetadata
 }
 
+// FileAddedReason describes why a file was added to an L0 compaction
+// candidate. See L0PickOptions.OnFileAdded.
+type FileAddedReason int8
+
+const (
+	// FileAddedSeed is the reason for the seed file of a candidate.
+	FileAddedSeed FileAddedReason = iota
+	// FileAddedStacking is the reason for the files in the seed interval that
+	// are stacked onto a candidate to deepen it.
+	FileAddedStacking
+	// FileAddedOverlap is the reason for the files that overlap files already
+	// in a candidate, and must be included for correctness: older files for a
+	// base compaction, and younger files for an intra-L0 compaction.
+	FileAddedOverlap
+	// FileAddedRectangle is the reason for the files added while extending a
+	// candidate into a more rectangular shape.
+	FileAddedRectangle
+	// FileAddedMerge is the reason for the files of adjacent base compactions
+	// merged into a candidate.
+	FileAddedMerge
+)
+
+// String implements fmt.Stringer.
+func (r FileAddedReason) String() string {
+	switch r {
+	case FileAddedSeed:
+		return "seed"
+	case FileAddedStacking:
+		return "stacking"
+	case FileAddedOverlap:
+		return "overlap"
+	case FileAddedRectangle:
+		return "rectangle"
+	case FileAddedMerge:
+		return "merge"
+	default:
+		return fmt.Sprintf("FileAddedReason(%d)", int8(r))
+	}
+}
+
+// FilesExamined returns the number of times the picker examined a file while
+// building and extending this candidate, including files that were skipped or
+// that stopped the candidate from growing further. A file may be examined more
+// than once, so this can exceed len(Files) considerably on large L0s. It
+// reflects the cost of picking the candidate better than the number of files
+// that were ultimately included.
+func (l *L0CompactionFiles) FilesExamined() int {
+	return l.filesExamined
+}
+
+// TotalBytes returns the sum of the sizes of the files in the candidate.
+func (l *L0CompactionFiles) TotalBytes() uint64 {
+	return l.fileBytes
+}
+
+// StackDepthReduction returns the number of sublevels that have a file in the
+// seed interval of the candidate that is part of the candidate, i.e. by how
+// much running the candidate reduces the stack depth of its seed interval.
+func (l *L0CompactionFiles) StackDepthReduction() int {
+	return l.seedIntervalStackDepthReduction
+}
+
+// BlockingFiles returns the compacting files that stopped the specified
+// compaction from growing to include more sublevels in its seed interval, or
+// nil if it wasn't stopped by compacting files. These are the files of a
+// sublevel that overlap the compaction and were already compacting when it was
+// picked, explaining compactions that are shallower than L0. Files excluded
+// through L0PickOptions.Excluded are reported as well. The returned slice must
+// not be modified.
+func (s *L0Sublevels) BlockingFiles(c *L0CompactionFiles) []*FileMetadata {
+	return c.blockingFiles
+}
+
+// SeqNumBounds returns the smallest and largest sequence numbers across the
+// files in the specified compaction. The output of an intra-L0 compaction
+// inherits this range, and for such compactions largest is guaranteed to be
+// below the earliestUnflushedSeqNum the compaction was picked with. Returns
+// zeroes if the compaction has no files.
+func (s *L0Sublevels) SeqNumBounds(c *L0CompactionFiles) (smallest, largest uint64) {
+	for i, f := range c.Files {
+		if i == 0 || f.SmallestSeqNum < smallest {
+			smallest = f.SmallestSeqNum
+		}
+		if f.LargestSeqNum > largest {
+			largest = f.LargestSeqNum
+		}
+	}
+	return smallest, largest
+}
+
+// SeedIntervalKey returns the start key of the seed interval of the specified
+// compaction, the interval that was chosen to bootstrap it. The seed interval
+// can be correlated with the intervals returned by IntervalBoundaryKeys and
+// ReadAmplificationByInterval. The returned key must not be modified.
+func (s *L0Sublevels) SeedIntervalKey(c *L0CompactionFiles) []byte {
+	return s.orderedIntervals[c.seedInterval].startKey.key
+}
+
+// SublevelBounds returns, for each sublevel with files in the specified
+// compaction, the smallest and largest internal keys of those files. Files in
+// a sublevel don't overlap, so the compaction's input from a sublevel can be
+// read by an iterator constrained to these bounds.
+func (s *L0Sublevels) SublevelBounds(c *L0CompactionFiles) map[int][2]InternalKey {
+	bounds := make(map[int][2]InternalKey)
+	for _, f := range c.Files {
+		b, ok := bounds[f.SubLevel]
+		if !ok {
+			bounds[f.SubLevel] = [2]InternalKey{f.Smallest, f.Largest}
+			continue
+		}
+		if base.InternalCompare(s.cmp, f.Smallest, b[0]) < 0 {
+			b[0] = f.Smallest
+		}
+		if base.InternalCompare(s.cmp, f.Largest, b[1]) > 0 {
+			b[1] = f.Largest
+		}
+		bounds[f.SubLevel] = b
+	}
+	return bounds
+}
+
+// EstimateBaseBytesByInterval estimates how the bytes that the specified base
+// compaction moves into Lbase are distributed across the key space. The
+// returned slice holds an estimate for each interval the compaction spans,
+// starting with its smallest interval, and attributes the compaction's bytes
+// in proportion to the estimated bytes of the intervals. Intervals with no
+// estimated bytes are attributed none, unless no interval has any, in which
+// case the bytes are attributed evenly. Due to rounding, the estimates may add
+// up to slightly less than the compaction's bytes.
+func (s *L0Sublevels) EstimateBaseBytesByInterval(c *L0CompactionFiles) []uint64 {
+	n := c.maxIntervalIndex - c.minIntervalIndex + 1
+	estimates := make([]uint64, n)
+	var totalBytes uint64
+	for i := c.minIntervalIndex; i <= c.maxIntervalIndex; i++ {
+		totalBytes += s.orderedIntervals[i].estimatedBytes
+	}
+	for i := range estimates {
+		if totalBytes == 0 {
+			estimates[i] = c.fileBytes / uint64(n)
+			continue
+		}
+		intervalBytes := s.orderedIntervals[c.minIntervalIndex+i].estimatedBytes
+		estimates[i] = uint64(float64(c.fileBytes) * float64(intervalBytes) / float64(totalBytes))
+	}
+	return estimates
+}
+
+// ShapeQuality returns the ratio of the stack depth reduction of the specified
+// compaction in its seed interval to the number of intervals it spans. Picked
+// compactions are preferably tall and thin rectangles, which relieve a lot of
+// read amplification while conflicting with few other compactions, and those
+// have a higher ShapeQuality. It is meant for comparing picking heuristics
+// rather than individual candidates, since the interval count depends on how
+// finely the file boundaries slice up the key space.
+func (s *L0Sublevels) ShapeQuality(c *L0CompactionFiles) float64 {
+	return float64(c.seedIntervalStackDepthReduction) /
+		float64(c.maxIntervalIndex-c.minIntervalIndex+1)
+}
+
+// SortedFiles returns a copy of the files of the specified compaction, sorted
+// in the order the compaction considered them: for a base compaction, from the
+// oldest sublevel to the youngest one, and for an intra-L0 compaction, from
+// the youngest sublevel to the oldest one. Files within a sublevel are sorted
+// by key.
+func (s *L0Sublevels) SortedFiles(c *L0CompactionFiles) []*FileMetadata {
+	files := append([]*FileMetadata(nil), c.Files...)
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].SubLevel != files[j].SubLevel {
+			return (files[i].SubLevel < files[j].SubLevel) != c.isIntraL0
+		}
+		return files[i].minIntervalIndex < files[j].minIntervalIndex
+	})
+	return files
+}
+
+// EfficiencyScore returns the stack depth reduction of the specified compaction
+// in its seed interval per byte of the L0 files it compacts, i.e. how much read
+// amplification it relieves per byte of I/O. Candidates with a higher score are
+// preferable when I/O is scarce. Returns 0 if the compaction has no bytes.
+func (s *L0Sublevels) EfficiencyScore(c *L0CompactionFiles) float64 {
+	if c.fileBytes == 0 {
+		return 0
+	}
+	return float64(c.seedIntervalStackDepthReduction) / float64(c.fileBytes)
+}
+
+// SplitCandidate splits the compaction candidate c into two candidates that
+// can run concurrently: one with the files of c that lie entirely in intervals
+// before the interval with index atIntervalIndex, and one with the files that
+// lie entirely in that interval and the ones after it. Returns false if a file
+// of c straddles the split, or if either candidate would be empty. Each
+// candidate keeps the seed interval of c if it lies within its interval range,
+// and otherwise uses its deepest interval as its seed.
+//
+// The two candidates are valid L0 compactions, since an L0 file overlapping
+// one of their files shares an interval with it. For base compactions, the
+// caller is responsible for checking that no Lbase file overlaps both
+// candidates, for instance by choosing a flush split key as the boundary of
+// the split interval.
+func (s *L0Sublevels) SplitCandidate(
+	c *L0CompactionFiles, atIntervalIndex int,
+) (*L0CompactionFiles, *L0CompactionFiles, bool) {
+	if atIntervalIndex <= c.minIntervalIndex || atIntervalIndex > c.maxIntervalIndex {
+		return nil, nil, false
+	}
+	var leftFiles, rightFiles []*FileMetadata
+	for _, f := range c.Files {
+		switch {
+		case f.maxIntervalIndex < atIntervalIndex:
+			leftFiles = append(leftFiles, f)
+		case f.minIntervalIndex >= atIntervalIndex:
+			rightFiles = append(rightFiles, f)
+		default:
+			return nil, nil, false
+		}
+	}
+	if len(leftFiles) == 0 || len(rightFiles) == 0 {
+		return nil, nil, false
+	}
+	return s.splitCandidateFrom(c, leftFiles), s.splitCandidateFrom(c, rightFiles), true
+}
+
+// splitCandidateFrom returns a candidate made up of the specified subset of
+// the files of c, inheriting the other properties of c.
+func (s *L0Sublevels) splitCandidateFrom(
+	c *L0CompactionFiles, files []*FileMetadata,
+) *L0CompactionFiles {
+	cFiles := &L0CompactionFiles{
+		FilesIncluded:           newBitSet(s.levelMetadata.Len()),
+		seedIntervalMinLevel:    c.seedIntervalMinLevel,
+		seedIntervalMaxLevel:    c.seedIntervalMaxLevel,
+		minIntervalIndex:        math.MaxInt32,
+		maxIntervalIndex:        0,
+		isIntraL0:               c.isIntraL0,
+		earliestUnflushedSeqNum: c.earliestUnflushedSeqNum,
+	}
+	for _, f := range files {
+		cFiles.addFile(f)
+	}
+	cFiles.preExtensionMinInterval = cFiles.minIntervalIndex
+	cFiles.preExtensionMaxInterval = cFiles.maxIntervalIndex
+
+	// The files in an interval are all in distinct sublevels, so the stack
+	// depth reduction of an interval is the number of its files in the
+	// candidate.
+	stackDepthReduction := func(index int) int {
+		n := 0
+		for _, f := range s.orderedIntervals[index].files {
+			if cFiles.FilesIncluded.Contains(f.L0Index) {
+				n++
+			}
+		}
+		return n
+	}
+	if c.seedInterval >= cFiles.minIntervalIndex && c.seedInterval <= cFiles.maxIntervalIndex {
+		cFiles.seedInterval = c.seedInterval
+		cFiles.seedIntervalStackDepthReduction = stackDepthReduction(c.seedInterval)
+		return cFiles
+	}
+	cFiles.seedInterval = cFiles.minIntervalIndex
+	for i := cFiles.minIntervalIndex; i <= cFiles.maxIntervalIndex; i++ {
+		if n := stackDepthReduction(i); n > cFiles.seedIntervalStackDepthReduction {
+			cFiles.seedInterval = i
+			cFiles.seedIntervalStackDepthReduction = n
+		}
+	}
+	return cFiles
+}
+
+// clone returns a copy of the LCF that can be modified independently.
+func (l *L0CompactionFiles) clone() *L0CompactionFiles {
+	c := *l
+	c.Files = append([]*FileMetadata(nil), l.Files...)
+	c.FilesIncluded = append(bitSet(nil), l.FilesIncluded...)
+	c.filesAdded = append([]*FileMetadata(nil), l.filesAdded...)
+	c.blockingFiles = append([]*FileMetadata(nil), l.blockingFiles...)
+	return &c
+}
+
+// isExcluded returns true if f was excluded from the candidate through
+// L0PickOptions.Excluded.
+func (l *L0CompactionFiles) isExcluded(f *FileMetadata) bool {
+	return l.excluded != nil && l.excluded.Contains(f.L0Index)
+}
+
+// unavailable returns true if f can't be added to the candidate because it is
+// compacting or excluded.
+func (l *L0CompactionFiles) unavailable(f *FileMetadata) bool {
+	return f.IsCompacting() || l.isExcluded(f)
+}
+
+// addFileFor adds the specified file to the LCF, reporting it to onFileAdded
+// with the specified reason if it wasn't included yet.
+func (l *L0CompactionFiles) addFileFor(f *FileMetadata, reason FileAddedReason) {
+	if l.onFileAdded != nil && !l.FilesIncluded.Contains(f.L0Index) {
+		l.onFileAdded(f, reason)
+	}
+	l.addFile(f)
+}
+
 // addFile adds the specified file to the LCF.
 func (l *L0CompactionFiles) addFile(f *FileMetadata) {
-	if l.FilesIncluded[f.L0Index] {
+	if l.FilesIncluded.Contains(f.L0Index) {
 		return
 	}
 	l.FilesIncluded.markBit(f.L0Index)
@@ -1167,12 +3377,26 @@ func (l *L0CompactionFiles) addFile(f *FileMetadata) {
 type intervalAndScore struct {
 	interval int
 	score    int
+	// misaligned is true if compactions seeded from the interval are likely
+	// to straddle a flush split key. Among intervals with equal scores,
+	// misaligned intervals are ordered last. See
+	// L0PickOptions.PreferFlushSplitAlignment.
+	misaligned bool
+	// bytes breaks ties between intervals with equal scores, which are
+	// ordered by decreasing bytes. See tiebreakBytes.
+	bytes int64
 }
 type intervalSorterByDecreasingScore []intervalAndScore
 
 func (is intervalSorterByDecreasingScore) Len() int { return len(is) }
 func (is intervalSorterByDecreasingScore) Less(i, j int) bool {
-	return is[i].score > is[j].score
+	if is[i].score != is[j].score {
+		return is[i].score > is[j].score
+	}
+	if is[i].misaligned != is[j].misaligned {
+		return !is[i].misaligned
+	}
+	return is[i].bytes > is[j].bytes
 }
 func (is intervalSorterByDecreasingScore) Swap(i, j int) {
 	is[i], is[j] = is[j], is[i]
@@ -1337,13 +3561,660 @@ func (is intervalSorterByDecreasingScore) Swap(i, j int) {
 //    Lbase a---------i    m---------w
 //
 
+// L0PickOptions configures the L0 compaction pickers. The zero value picks
+// compactions using the default heuristics.
+type L0PickOptions struct {
+	// Avoid, if non-nil, is a user key range that PickBaseCompaction must not
+	// pick a compaction in. Intervals overlapping Avoid are not considered as
+	// seed intervals, and candidates that grow into Avoid are rejected. This
+	// lets callers steer compactions away from a key range that is about to
+	// be ingested into.
+	Avoid *UserKeyRange
+
+	// MaxSublevels, if positive, is the number of sublevels beyond which
+	// PickIntraL0Compaction flattens L0 aggressively, by lowering its
+	// minCompactionDepth to aggressiveIntraL0MinDepth. This is useful when
+	// sublevels keep accumulating because no base compaction can be picked.
+	MaxSublevels int
+
+	// PrioritizeDeepest, if true, makes PickBaseCompaction score intervals
+	// strictly by depth, so the deepest eligible interval is always considered
+	// first. By default, intervals that are unlikely to conflict with ongoing
+	// base compactions are prioritized, which favors compaction concurrency
+	// over relieving the worst read amplification hotspot first.
+	PrioritizeDeepest bool
+
+	// PreferFlushSplitAlignment, if true, makes PickIntraL0Compaction prefer
+	// seed intervals whose newest file doesn't straddle a flush split key over
+	// those of equal depth whose newest file does. Compactions seeded from the
+	// latter tend to produce output files that straddle flush split keys. This
+	// only changes the order in which seed intervals are considered.
+	PreferFlushSplitAlignment bool
+
+	// MergeAdjacentSeeds, if true, makes PickBaseCompaction merge the picked
+	// compaction with the compactions seeded from the nearest deep intervals
+	// on either side of it, as long as the combined compaction stays within
+	// the byte limits used when growing candidates. This results in fewer,
+	// wider compactions, which suits nodes with little compaction concurrency.
+	MergeAdjacentSeeds bool
+
+	// CreatedBefore, if positive, restricts PickBaseCompaction to seed
+	// intervals in which the majority of non-compacting files were created
+	// before CreatedBefore, in seconds since the epoch. This serves compacting
+	// cold data down to Lbase, for instance to reclaim space through TTLs,
+	// rather than reducing read amplification. Files newer than CreatedBefore
+	// may still be included in the compaction, when required for correctness or
+	// when the candidate is grown.
+	CreatedBefore int64
+
+	// SkipCompactingSeeds, if true, makes PickBaseCompaction skip seed
+	// intervals whose seed file is unexpectedly compacting, instead of
+	// returning an error. This can happen benignly if the compacting state of
+	// L0 is momentarily stale, for instance when a concurrent compaction has
+	// started but UpdateStateForStartedCompaction has not been called yet. The
+	// default is to return an error, which catches inconsistencies in tests.
+	SkipCompactingSeeds bool
+
+	// BaseSplitKeys, if non-empty, are the user keys at which the output of a
+	// compaction into Lbase is split, such as Lbase's own flush split keys, in
+	// increasing order. PickBaseCompaction then tries to extend the picked
+	// compaction so that its key range starts and ends at the split keys
+	// surrounding it, so that its output files line up with the Lbase
+	// boundaries. The extension is skipped if it would conflict with compacting
+	// Lbase files, grow into Avoid, or make the compaction too large.
+	BaseSplitKeys [][]byte
+
+	// ByteTiebreak specifies how PickBaseCompaction and PickIntraL0Compaction
+	// order seed intervals with equal scores, which is common during bulk
+	// ingestion, when many intervals have the same depth.
+	ByteTiebreak IntervalByteTiebreak
+
+	// CenteredFileRadius, if positive, makes PickBaseCompaction score seed
+	// intervals by the number of non-compacting files centered on them, rather
+	// than by depth. A file is centered on an interval if both of its interval
+	// bounds are within CenteredFileRadius intervals of it. Wide files crossing
+	// many intervals then don't inflate the score of all of them, which targets
+	// compactions at regions congested with files of their own, rather than
+	// regions that are merely crossed by wide files. Seed intervals must still
+	// have a depth of at least minCompactionDepth.
+	CenteredFileRadius int
+
+	// WideSeedFileBonus, if positive, is added to the score of seed intervals
+	// whose seed file, the file in the lowest sublevel, is wide, when
+	// PickBaseCompaction orders them. Wide files in low sublevels force every
+	// base compaction overlapping them to include them, which limits
+	// compaction concurrency, so compacting them first frees up room for more
+	// concurrent base compactions later. A file is wide if it spans at least
+	// WideSeedFileMinIntervals intervals, or more than one interval if
+	// WideSeedFileMinIntervals is not positive.
+	WideSeedFileBonus        int
+	WideSeedFileMinIntervals int
+
+	// ClosedRectangles, if true, makes PickBaseCompaction only pick
+	// compactions in which no file extends beyond the key range of the seed
+	// file. Growing the compaction through a file that would widen its
+	// interval range is rejected instead, and if the seed file itself overlaps
+	// such a file in a lower sublevel, the seed interval is skipped. Since
+	// these compactions never pull in wide files that overlap other regions of
+	// the key space, they are the safest to run many of in parallel.
+	ClosedRectangles bool
+
+	// MaxIntervalSpan, if positive, bounds the number of intervals that the
+	// compactions picked by PickBaseCompaction may span. Candidates stop
+	// growing once another step would span more intervals, like they do when
+	// growing too large in bytes, and seed intervals whose seed file alone
+	// spans more intervals are skipped. Compactions are extended through
+	// MergeAdjacentSeeds and BaseSplitKeys only within the bound. Unlike the
+	// byte limits, this bounds wide compactions of many small files, which
+	// take long to run and block concurrent compactions over their key range.
+	MaxIntervalSpan int
+
+	// Excluded, if non-empty, holds L0 files that picked compactions must not
+	// include, such as files pinned by an open iterator. Excluded files are
+	// treated like compacting files: seed intervals whose seed file is
+	// excluded are skipped, and candidates stop growing, or are not picked,
+	// rather than include an excluded file. Files that are not part of the
+	// receiver L0Sublevels are ignored.
+	Excluded []*FileMetadata
+	// excluded holds the L0Index of every file in Excluded. It is populated by
+	// the compaction pickers, see withExcluded.
+	excluded bitSet
+
+	// OnFileAdded, if non-nil, is called for each file added to a candidate
+	// while picking a compaction, and while extending the picked compaction,
+	// with the reason the file was added. This traces how the compaction was
+	// assembled. Files added to candidates that were later abandoned, for
+	// instance because they grew too large, are reported too. Picked base
+	// compactions are not cached when OnFileAdded is set.
+	OnFileAdded func(f *FileMetadata, reason FileAddedReason)
+
+	// IntervalScorer, if non-nil, replaces the heuristic ordering the seed
+	// intervals PickBaseCompaction considers, which are considered in
+	// decreasing order of score. Only intervals that are eligible as seed
+	// intervals are scored. CenteredFileRadius, WideSeedFileBonus and
+	// PrioritizeDeepest, which adjust the default heuristic, are ignored.
+	// Picked base compactions are not cached when IntervalScorer is set.
+	IntervalScorer IntervalScorer
+
+	// Limits, if non-nil, overrides the limits on how large picked compactions
+	// grow in bytes. See L0CompactionLimits for the defaults.
+	Limits *L0CompactionLimits
+}
+
+// L0CompactionLimits limits how large L0 compactions grow in bytes. Very long
+// running compactions reduce concurrency while they run, and take a while to
+// produce results, though adding more depth to a compaction is more efficient
+// in reducing stack depth. Once a candidate reaches the minimum compaction
+// depth, it stops growing if another step would grow it beyond MinGrowthBytes
+// and either grow it by more than GrowthRatio or beyond HardMaxBytes. This
+// prefers slow growths as files are added, while still having a hard limit.
+// HardMaxBytes also limits the growth of picked compactions through
+// L0PickOptions.MergeAdjacentSeeds and L0PickOptions.BaseSplitKeys.
+type L0CompactionLimits struct {
+	// MinGrowthBytes is the size up to which candidates may grow by any
+	// ratio. It defaults to 100MB.
+	MinGrowthBytes uint64
+	// GrowthRatio is the largest ratio by which the size of a candidate may
+	// grow in one step, once it is larger than MinGrowthBytes. It must be
+	// positive, and defaults to 1.5.
+	GrowthRatio float64
+	// HardMaxBytes is the size beyond which candidates stop growing. It must
+	// be at least MinGrowthBytes, and defaults to 500MB.
+	HardMaxBytes uint64
+}
+
+// defaultL0CompactionLimits are the limits used when L0PickOptions.Limits is
+// nil.
+var defaultL0CompactionLimits = L0CompactionLimits{
+	MinGrowthBytes: 100 << 20,
+	GrowthRatio:    1.5,
+	HardMaxBytes:   500 << 20,
+}
+
+// validate returns an error if the limits are invalid. nil limits are valid.
+func (l *L0CompactionLimits) validate() error {
+	if l == nil {
+		return nil
+	}
+	if l.GrowthRatio <= 0 {
+		return errors.Errorf("pebble: L0 compaction growth ratio must be positive, got %g", l.GrowthRatio)
+	}
+	if l.HardMaxBytes < l.MinGrowthBytes {
+		return errors.Errorf("pebble: L0 compaction hard max bytes %d is below min growth bytes %d",
+			l.HardMaxBytes, l.MinGrowthBytes)
+	}
+	return nil
+}
+
+// stopGrowth returns true if the candidate c, grown from lastCandidate, has
+// grown too large per the limits.
+func (l *L0CompactionLimits) stopGrowth(c, lastCandidate *L0CompactionFiles) bool {
+	return c.fileBytes > l.MinGrowthBytes &&
+		(float64(c.fileBytes)/float64(lastCandidate.fileBytes) > l.GrowthRatio || c.fileBytes > l.HardMaxBytes)
+}
+
+// withExcluded returns opts with opts.excluded populated from opts.Excluded.
+func (s *L0Sublevels) withExcluded(opts L0PickOptions) L0PickOptions {
+	if len(opts.Excluded) == 0 {
+		return opts
+	}
+	opts.excluded = newBitSet(s.levelMetadata.Len())
+	for _, f := range opts.Excluded {
+		if _, _, ok := s.FileIntervalRange(f); ok {
+			opts.excluded.markBit(f.L0Index)
+		}
+	}
+	return opts
+}
+
+// isExcluded returns true if f is one of o.Excluded. Requires o.excluded to be
+// populated, see withExcluded.
+func (o *L0PickOptions) isExcluded(f *FileMetadata) bool {
+	return o.excluded != nil && o.excluded.Contains(f.L0Index)
+}
+
+// exceedsIntervalSpan returns true if the interval range [minIntervalIndex,
+// maxIntervalIndex] spans more intervals than o.MaxIntervalSpan allows.
+func (o *L0PickOptions) exceedsIntervalSpan(minIntervalIndex, maxIntervalIndex int) bool {
+	return o.MaxIntervalSpan > 0 && maxIntervalIndex-minIntervalIndex+1 > o.MaxIntervalSpan
+}
+
+// limits returns the compaction limits to use for the options.
+func (o *L0PickOptions) limits() *L0CompactionLimits {
+	if o.Limits != nil {
+		return o.Limits
+	}
+	return &defaultL0CompactionLimits
+}
+
+// IntervalByteTiebreak specifies how the compaction pickers order intervals
+// with equal scores.
+type IntervalByteTiebreak int8
+
+const (
+	// IntervalByteTiebreakNone leaves the order of intervals with equal scores
+	// unspecified.
+	IntervalByteTiebreakNone IntervalByteTiebreak = iota
+	// IntervalByteTiebreakHeavier prefers intervals with more estimated bytes,
+	// which reclaims more space per compaction.
+	IntervalByteTiebreakHeavier
+	// IntervalByteTiebreakLighter prefers intervals with fewer estimated bytes,
+	// which results in faster compactions.
+	IntervalByteTiebreakLighter
+)
+
+// tiebreakBytes returns the value of intervalAndScore.bytes for the specified
+// interval, such that intervals are ordered according to tiebreak.
+func tiebreakBytes(interval *fileInterval, tiebreak IntervalByteTiebreak) int64 {
+	switch tiebreak {
+	case IntervalByteTiebreakHeavier:
+		return int64(interval.estimatedBytes)
+	case IntervalByteTiebreakLighter:
+		return -int64(interval.estimatedBytes)
+	default:
+		return 0
+	}
+}
+
+// straddlesFlushSplitKey returns true if the file f spans a flush split key,
+// i.e. a flush split key is placed at an interval f overlaps, other than the
+// first one.
+func (s *L0Sublevels) straddlesFlushSplitKey(f *FileMetadata) bool {
+	k := sort.SearchInts(s.flushSplitIntervals, f.minIntervalIndex+1)
+	return k < len(s.flushSplitIntervals) && s.flushSplitIntervals[k] <= f.maxIntervalIndex
+}
+
+// L0IntervalInfo describes an interval to an IntervalScorer.
+type L0IntervalInfo struct {
+	// Index is the index of the interval.
+	Index int
+	// FileCount is the number of files overlapping the interval, and
+	// CompactingFileCount the number of those that are compacting.
+	FileCount           int
+	CompactingFileCount int
+	// EstimatedBytes is the estimated bytes of L0 within the interval.
+	EstimatedBytes uint64
+	// IntervalRangeIsBaseCompacting is true if the files overlapping the
+	// interval overlap a base compacting interval, which makes compactions
+	// seeded from the interval likely to be blocked by ongoing base
+	// compactions.
+	IntervalRangeIsBaseCompacting bool
+	// SeedFileIntervals is the number of intervals spanned by the oldest file
+	// overlapping the interval, which seeds base compactions.
+	SeedFileIntervals int
+}
+
+// IntervalScorer scores the seed intervals of base compactions, which are
+// considered in decreasing order of score. sublevelCount is the number of
+// sublevels. See L0PickOptions.IntervalScorer.
+type IntervalScorer func(interval L0IntervalInfo, sublevelCount int) int
+
+// DefaultIntervalScorer is the IntervalScorer that PickBaseCompaction uses by
+// default. It scores intervals by their depth after ongoing compactions
+// complete, but prioritizes all intervals that are unlikely to be blocked by
+// ongoing base compactions over the others, by adding the number of sublevels
+// to their score. This ordering was observed to work well for an import into
+// CockroachDB, but it is not known to be a good heuristic in general.
+func DefaultIntervalScorer(interval L0IntervalInfo, sublevelCount int) int {
+	score := interval.FileCount - interval.CompactingFileCount
+	if !interval.IntervalRangeIsBaseCompacting {
+		score += sublevelCount
+	}
+	return score
+}
+
+// aggressiveIntraL0MinDepth is the minCompactionDepth used by
+// PickIntraL0Compaction when the sublevel count exceeds
+// L0PickOptions.MaxSublevels. An intra-L0 compaction of a single sublevel does
+// not reduce stack depth, so this is the smallest useful depth.
+const aggressiveIntraL0MinDepth = 2
+
+// intraL0MinDepth returns the minCompactionDepth to use when picking an
+// intra-L0 compaction, given the depth requested by the caller.
+func (s *L0Sublevels) intraL0MinDepth(minCompactionDepth int, opts L0PickOptions) int {
+	if opts.MaxSublevels > 0 && len(s.levelFiles) > opts.MaxSublevels &&
+		minCompactionDepth > aggressiveIntraL0MinDepth {
+		return aggressiveIntraL0MinDepth
+	}
+	return minCompactionDepth
+}
+
+// checkMinCompactionDepth returns an error if minCompactionDepth, as passed to
+// the compaction pickers, is not positive. Every interval has a depth of at
+// least 0, so such a depth would let the pickers seed compactions from empty
+// intervals.
+func checkMinCompactionDepth(minCompactionDepth int) error {
+	if minCompactionDepth < 1 {
+		return errors.Errorf("pebble: minCompactionDepth must be at least 1, got %d", minCompactionDepth)
+	}
+	return nil
+}
+
 // PickBaseCompaction picks a base compaction based on the above specified
 // heuristics, for the specified Lbase files and a minimum depth of overlapping
 // files that can be selected for compaction. Returns nil if no compaction is
 // possible.
 func (s *L0Sublevels) PickBaseCompaction(
-	minCompactionDepth int, baseFiles LevelSlice,
+	minCompactionDepth int, baseFiles LevelSlice, opts L0PickOptions,
+) (*L0CompactionFiles, error) {
+	if err := checkMinCompactionDepth(minCompactionDepth); err != nil {
+		return nil, err
+	}
+	if err := opts.Limits.validate(); err != nil {
+		return nil, err
+	}
+	if !s.opts.CacheBasePicks || opts.OnFileAdded != nil || opts.IntervalScorer != nil {
+		return s.pickBaseCompaction(minCompactionDepth, collectCompactingBaseRanges(baseFiles), opts)
+	}
+	// The pick depends on Lbase files through their compacting state only,
+	// which InitCompactingFileInfo drops the cache for, so a cache hit doesn't
+	// need to look at baseFiles.
+	if e := s.basePickCache; e != nil && e.matches(s.generation, minCompactionDepth, opts) {
+		if e.c == nil {
+			return nil, nil
+		}
+		return e.c.clone(), nil
+	}
+	c, err := s.pickBaseCompaction(minCompactionDepth, collectCompactingBaseRanges(baseFiles), opts)
+	if err != nil {
+		return nil, err
+	}
+	e := &basePickCacheEntry{
+		generation:         s.generation,
+		minCompactionDepth: minCompactionDepth,
+		opts:               opts,
+	}
+	if opts.Avoid != nil {
+		e.opts.Avoid = &UserKeyRange{
+			Start: append([]byte(nil), opts.Avoid.Start...),
+			End:   append([]byte(nil), opts.Avoid.End...),
+		}
+	}
+	if opts.Limits != nil {
+		limits := *opts.Limits
+		e.opts.Limits = &limits
+	}
+	if opts.Excluded != nil {
+		e.opts.Excluded = append([]*FileMetadata(nil), opts.Excluded...)
+	}
+	if opts.BaseSplitKeys != nil {
+		e.opts.BaseSplitKeys = make([][]byte, len(opts.BaseSplitKeys))
+		for i, key := range opts.BaseSplitKeys {
+			e.opts.BaseSplitKeys[i] = append([]byte(nil), key...)
+		}
+	}
+	if c != nil {
+		// The caller may extend the returned candidate, so cache a copy.
+		e.c = c.clone()
+	}
+	s.basePickCache = e
+	return c, nil
+}
+
+func (s *L0Sublevels) pickBaseCompaction(
+	minCompactionDepth int, compactingBase compactingBaseRanges, opts L0PickOptions,
+) (*L0CompactionFiles, error) {
+	opts = s.withExcluded(opts)
+	scoredIntervals, avoidStart, avoidEnd := s.scoreBaseIntervals(minCompactionDepth, opts)
+
+	// Optimization to avoid considering different intervals that
+	// are likely to choose the same seed file. Again this is just
+	// to reduce wasted work.
+	consideredIntervals := newBitSet(len(s.orderedIntervals))
+	var filesIncluded bitSet
+	for _, scoredInterval := range scoredIntervals {
+		c, err := s.baseCompactionForInterval(
+			scoredInterval.interval, minCompactionDepth, compactingBase, opts, avoidStart, avoidEnd,
+			consideredIntervals, &filesIncluded)
+		if err != nil || c != nil {
+			return c, err
+		}
+	}
+	return nil, nil
+}
+
+// PickCheapestBaseCompaction builds base compactions for the k highest scored
+// seed intervals that yield one, in the order PickBaseCompaction considers
+// them, and returns the one overlapping the fewest bytes of the specified
+// Lbase files. Ties are broken in favor of the higher scored candidate. This
+// trades some read amplification relief for cheaper compactions, when Lbase
+// I/O is the bottleneck. Returns nil if no compaction is possible.
+func (s *L0Sublevels) PickCheapestBaseCompaction(
+	minCompactionDepth int, baseFiles LevelSlice, k int,
+) (*L0CompactionFiles, error) {
+	if err := checkMinCompactionDepth(minCompactionDepth); err != nil {
+		return nil, err
+	}
+	if k < 1 {
+		return nil, errors.Errorf("pebble: k must be at least 1, got %d", k)
+	}
+	var opts L0PickOptions
+	scoredIntervals, avoidStart, avoidEnd := s.scoreBaseIntervals(minCompactionDepth, opts)
+	consideredIntervals := newBitSet(len(s.orderedIntervals))
+	compactingBase := collectCompactingBaseRanges(baseFiles)
+	var filesIncluded bitSet
+	var cheapest *L0CompactionFiles
+	var cheapestBytes uint64
+	for _, scoredInterval := range scoredIntervals {
+		c, err := s.baseCompactionForInterval(
+			scoredInterval.interval, minCompactionDepth, compactingBase, opts, avoidStart, avoidEnd,
+			consideredIntervals, &filesIncluded)
+		if err != nil {
+			return nil, err
+		}
+		if c == nil {
+			continue
+		}
+		if b := s.baseOverlapBytes(c, baseFiles); cheapest == nil || b < cheapestBytes {
+			cheapest, cheapestBytes = c, b
+		}
+		if k--; k == 0 {
+			break
+		}
+	}
+	return cheapest, nil
+}
+
+// PickBaseCompactionCandidates builds base compactions for the k highest
+// scored seed intervals that yield one, and returns them sorted by the stack
+// depth reduction of their seed intervals, in descending order. Candidates
+// with the same stack depth reduction remain in the order PickBaseCompaction
+// considers them. The candidates are alternatives to one another and may
+// overlap, so the caller is expected to apply its own cost model and pick at
+// most one of them. Each candidate has its own FilesIncluded. Returns an empty
+// slice if no compaction is possible.
+func (s *L0Sublevels) PickBaseCompactionCandidates(
+	minCompactionDepth int, baseFiles LevelSlice, k int,
+) ([]*L0CompactionFiles, error) {
+	if err := checkMinCompactionDepth(minCompactionDepth); err != nil {
+		return nil, err
+	}
+	if k < 1 {
+		return nil, errors.Errorf("pebble: k must be at least 1, got %d", k)
+	}
+	var opts L0PickOptions
+	scoredIntervals, avoidStart, avoidEnd := s.scoreBaseIntervals(minCompactionDepth, opts)
+	consideredIntervals := newBitSet(len(s.orderedIntervals))
+	compactingBase := collectCompactingBaseRanges(baseFiles)
+	var filesIncluded bitSet
+	var candidates []*L0CompactionFiles
+	for _, scoredInterval := range scoredIntervals {
+		c, err := s.baseCompactionForInterval(
+			scoredInterval.interval, minCompactionDepth, compactingBase, opts, avoidStart, avoidEnd,
+			consideredIntervals, &filesIncluded)
+		if err != nil {
+			return nil, err
+		}
+		if c == nil {
+			continue
+		}
+		candidates = append(candidates, c)
+		if len(candidates) == k {
+			break
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].seedIntervalStackDepthReduction > candidates[j].seedIntervalStackDepthReduction
+	})
+	return candidates, nil
+}
+
+// unboundedL0CompactionLimits are L0CompactionLimits under which candidates
+// grow without regard to their size.
+var unboundedL0CompactionLimits = L0CompactionLimits{
+	MinGrowthBytes: math.MaxUint64,
+	GrowthRatio:    1.5,
+	HardMaxBytes:   math.MaxUint64,
+}
+
+// PickCompactionToReduceSublevelsBelow picks a base compaction to bring the
+// number of sublevels back to at most target, which puts a hard ceiling on the
+// read amplification of L0. Returns nil if there are at most target sublevels
+// already, or if no compaction is possible. The compaction is picked like
+// PickBaseCompaction does, except that the deepest seed intervals are always
+// considered first, and candidates keep growing beyond the byte limits on
+// L0 compactions, to reduce the tallest stacks as much as possible. The
+// resulting compactions can be very large, so this is meant to be used only
+// when sublevels accumulate faster than regular compactions can keep up.
+func (s *L0Sublevels) PickCompactionToReduceSublevelsBelow(
+	target int, minCompactionDepth int, baseFiles LevelSlice,
 ) (*L0CompactionFiles, error) {
+	if target < 1 {
+		return nil, errors.Errorf("pebble: target sublevel count must be at least 1, got %d", target)
+	}
+	if err := checkMinCompactionDepth(minCompactionDepth); err != nil {
+		return nil, err
+	}
+	if len(s.Levels) <= target {
+		return nil, nil
+	}
+	opts := L0PickOptions{
+		PrioritizeDeepest: true,
+		Limits:            &unboundedL0CompactionLimits,
+	}
+	return s.pickBaseCompaction(minCompactionDepth, collectCompactingBaseRanges(baseFiles), opts)
+}
+
+// baseOverlapBytes returns the total size of the specified Lbase files that
+// overlap the compaction c.
+func (s *L0Sublevels) baseOverlapBytes(c *L0CompactionFiles, baseFiles LevelSlice) uint64 {
+	var size uint64
+	s.visitOverlappingBaseFiles(c.minIntervalIndex, c.maxIntervalIndex, baseFiles,
+		func(m *FileMetadata) bool {
+			size += m.Size
+			return true
+		})
+	return size
+}
+
+// CandidateIterator yields base compaction candidates lazily, in the order
+// PickBaseCompaction considers them. See BaseCompactionCandidates.
+type CandidateIterator struct {
+	s                  *L0Sublevels
+	minCompactionDepth int
+	baseFiles          LevelSlice
+	opts               L0PickOptions
+
+	scored              bool
+	scoredIntervals     []intervalAndScore
+	avoidStart          int
+	avoidEnd            int
+	index               int
+	consideredIntervals bitSet
+	compactingBase      compactingBaseRanges
+	// filesIncluded is reused across unsuccessful attempts to build candidates.
+	filesIncluded bitSet
+	// yielded holds the candidates returned so far, and yieldedBaseFiles the
+	// Lbase files overlapping them.
+	yielded          []*L0CompactionFiles
+	yieldedBaseFiles map[*FileMetadata]struct{}
+}
+
+// BaseCompactionCandidates returns an iterator over the base compactions that
+// can be picked with the specified arguments, which have the same meaning as
+// for PickBaseCompaction. The first candidate is the one PickBaseCompaction
+// returns. Each subsequent candidate overlaps neither the L0 intervals nor the
+// Lbase files of the previous ones, so all of them can run concurrently.
+// Candidates are computed as Next is called, so callers that only need a few
+// candidates don't pay for computing all of them.
+//
+// The compacting state of the receiver must not change while the iterator is
+// in use. Extending a candidate, such as with ExtendL0ForBaseCompactionTo, may
+// make it overlap later candidates, so callers starting several candidates
+// should extend each one before calling Next again and check for overlaps.
+func (s *L0Sublevels) BaseCompactionCandidates(
+	minCompactionDepth int, baseFiles LevelSlice, opts L0PickOptions,
+) *CandidateIterator {
+	return &CandidateIterator{
+		s:                  s,
+		minCompactionDepth: minCompactionDepth,
+		baseFiles:          baseFiles,
+		opts:               s.withExcluded(opts),
+	}
+}
+
+// Next returns the next candidate, or nil if there are no more candidates.
+func (it *CandidateIterator) Next() (*L0CompactionFiles, error) {
+	s := it.s
+	if err := checkMinCompactionDepth(it.minCompactionDepth); err != nil {
+		return nil, err
+	}
+	if err := it.opts.Limits.validate(); err != nil {
+		return nil, err
+	}
+	if !it.scored {
+		it.scoredIntervals, it.avoidStart, it.avoidEnd = s.scoreBaseIntervals(it.minCompactionDepth, it.opts)
+		it.consideredIntervals = newBitSet(len(s.orderedIntervals))
+		it.compactingBase = collectCompactingBaseRanges(it.baseFiles)
+		it.yieldedBaseFiles = make(map[*FileMetadata]struct{})
+		it.scored = true
+	}
+	for it.index < len(it.scoredIntervals) {
+		intervalIndex := it.scoredIntervals[it.index].interval
+		it.index++
+		c, err := s.baseCompactionForInterval(
+			intervalIndex, it.minCompactionDepth, it.compactingBase, it.opts, it.avoidStart, it.avoidEnd,
+			it.consideredIntervals, &it.filesIncluded)
+		if err != nil {
+			return nil, err
+		}
+		if c == nil || it.overlapsYielded(c) {
+			continue
+		}
+		it.yielded = append(it.yielded, c)
+		s.visitOverlappingBaseFiles(c.minIntervalIndex, c.maxIntervalIndex, it.baseFiles,
+			func(m *FileMetadata) bool {
+				it.yieldedBaseFiles[m] = struct{}{}
+				return true
+			})
+		return c, nil
+	}
+	return nil, nil
+}
+
+// overlapsYielded returns true if the candidate c overlaps the intervals or the
+// Lbase files of a previously yielded candidate.
+func (it *CandidateIterator) overlapsYielded(c *L0CompactionFiles) bool {
+	for _, y := range it.yielded {
+		if c.minIntervalIndex <= y.maxIntervalIndex && c.maxIntervalIndex >= y.minIntervalIndex {
+			return true
+		}
+	}
+	overlaps := false
+	it.s.visitOverlappingBaseFiles(c.minIntervalIndex, c.maxIntervalIndex, it.baseFiles,
+		func(m *FileMetadata) bool {
+			_, overlaps = it.yieldedBaseFiles[m]
+			return !overlaps
+		})
+	return overlaps
+}
+
+// scoreBaseIntervals returns the intervals to consider as seed intervals for a
+// base compaction, in the order they should be considered, along with the
+// range of intervals [avoidStart, avoidEnd) overlapping opts.Avoid.
+func (s *L0Sublevels) scoreBaseIntervals(
+	minCompactionDepth int, opts L0PickOptions,
+) (scoredIntervals []intervalAndScore, avoidStart, avoidEnd int) {
 	// For LBase compactions, we consider intervals in a greedy manner in the
 	// following order:
 	// - Intervals that are unlikely to be blocked due
@@ -1356,7 +4227,13 @@ func (s *L0Sublevels) PickBaseCompaction(
 	// construct a compaction for it and compare the constructed compactions
 	// and pick the best one. If microbenchmarks show that we can afford
 	// this cost we can eliminate this heuristic.
-	scoredIntervals := make([]intervalAndScore, 0, len(s.orderedIntervals))
+	//
+	// Intervals in [avoidStart, avoidEnd) overlap opts.Avoid, and are never
+	// considered.
+	if opts.Avoid != nil {
+		avoidStart, avoidEnd = s.intervalRange(opts.Avoid.Start, opts.Avoid.End)
+	}
+	scoredIntervals = make([]intervalAndScore, 0, len(s.orderedIntervals))
 	sublevelCount := len(s.levelFiles)
 	for i := range s.orderedIntervals {
 		interval := &s.orderedIntervals[i]
@@ -1364,94 +4241,503 @@ func (s *L0Sublevels) PickBaseCompaction(
 		if interval.isBaseCompacting || minCompactionDepth > depth {
 			continue
 		}
-		if interval.intervalRangeIsBaseCompacting {
-			scoredIntervals = append(scoredIntervals, intervalAndScore{interval: i, score: depth})
+		if i >= avoidStart && i < avoidEnd {
+			continue
+		}
+		if opts.CreatedBefore > 0 && !interval.mostlyCreatedBefore(opts.CreatedBefore) {
+			continue
+		}
+		tiebreak := tiebreakBytes(interval, opts.ByteTiebreak)
+		// The seed file is never nil, but if it is, baseCompactionForInterval
+		// returns an error for the interval, so score it without the seed file.
+		seed := interval.files[0]
+		seedFileIntervals := 0
+		if seed != nil {
+			seedFileIntervals = seed.maxIntervalIndex - seed.minIntervalIndex + 1
+		}
+		if opts.IntervalScorer != nil {
+			score := opts.IntervalScorer(L0IntervalInfo{
+				Index:                         i,
+				FileCount:                     len(interval.files),
+				CompactingFileCount:           interval.compactingFileCount,
+				EstimatedBytes:                interval.estimatedBytes,
+				IntervalRangeIsBaseCompacting: interval.intervalRangeIsBaseCompacting,
+				SeedFileIntervals:             seedFileIntervals,
+			}, sublevelCount)
+			scoredIntervals = append(scoredIntervals, intervalAndScore{interval: i, score: score, bytes: tiebreak})
+			continue
+		}
+		score := depth
+		if opts.CenteredFileRadius > 0 {
+			score = interval.centeredFileCount(opts.CenteredFileRadius)
+		}
+		if opts.WideSeedFileBonus > 0 {
+			minIntervals := opts.WideSeedFileMinIntervals
+			if minIntervals <= 0 {
+				minIntervals = 2
+			}
+			if seedFileIntervals >= minIntervals {
+				score += opts.WideSeedFileBonus
+			}
+		}
+		if interval.intervalRangeIsBaseCompacting || opts.PrioritizeDeepest {
+			scoredIntervals = append(scoredIntervals, intervalAndScore{interval: i, score: score, bytes: tiebreak})
 		} else {
 			// Prioritize this interval by incrementing the score by the number
 			// of sublevels.
-			scoredIntervals = append(scoredIntervals, intervalAndScore{interval: i, score: depth + sublevelCount})
+			scoredIntervals = append(scoredIntervals, intervalAndScore{interval: i, score: score + sublevelCount, bytes: tiebreak})
 		}
 	}
 	sort.Sort(intervalSorterByDecreasingScore(scoredIntervals))
+	return scoredIntervals, avoidStart, avoidEnd
+}
 
-	// Optimization to avoid considering different intervals that
-	// are likely to choose the same seed file. Again this is just
-	// to reduce wasted work.
-	consideredIntervals := newBitSet(len(s.orderedIntervals))
-	for _, scoredInterval := range scoredIntervals {
-		interval := &s.orderedIntervals[scoredInterval.interval]
-		if consideredIntervals[interval.index] {
-			continue
+// baseCompactionForInterval returns the base compaction seeded from the
+// interval with the specified index, or nil if no compaction can be picked
+// from it. Intervals covered by the seed file are marked in
+// consideredIntervals, and skipped if already marked. The storage of
+// *filesIncluded, if any, is reused for the FilesIncluded of the candidate. It
+// is handed over to the returned compaction, leaving *filesIncluded nil, so
+// that a single bitSet is reused across unsuccessful attempts.
+func (s *L0Sublevels) baseCompactionForInterval(
+	intervalIndex int,
+	minCompactionDepth int,
+	compactingBase compactingBaseRanges,
+	opts L0PickOptions,
+	avoidStart, avoidEnd int,
+	consideredIntervals bitSet,
+	filesIncluded *bitSet,
+) (*L0CompactionFiles, error) {
+	interval := &s.orderedIntervals[intervalIndex]
+	if consideredIntervals.Contains(interval.index) {
+		return nil, nil
+	}
+
+	// Pick the seed file for the interval as the file
+	// in the lowest sub-level.
+	f := interval.files[0]
+	// The seed file must be checked before any of its fields are accessed.
+	if f == nil {
+		return nil, errors.New("no seed file found in sublevel intervals")
+	}
+	// Don't bother considering the intervals that are
+	// covered by the seed file since they are likely
+	// nearby. Note that it is possible that those intervals
+	// have seed files at lower sub-levels so could be
+	// viable for compaction.
+	consideredIntervals.markBits(f.minIntervalIndex, f.maxIntervalIndex+1)
+	if opts.isExcluded(f) {
+		return nil, nil
+	}
+	if f.IsCompacting() {
+		if f.IsIntraL0Compacting {
+			// If we're picking a base compaction and we came across a
+			// seed file candidate that's being intra-L0 compacted, skip
+			// the interval instead of erroring out.
+			return nil, nil
+		}
+		if opts.SkipCompactingSeeds {
+			return nil, nil
 		}
+		// We chose a compaction seed file that should not be
+		// compacting. Usually means the score is not accurately
+		// accounting for files already compacting, or internal state is
+		// inconsistent.
+		return nil, errors.Errorf("file %s chosen as seed file for compaction should not be compacting", f.FileNum)
+	}
 
-		// Pick the seed file for the interval as the file
-		// in the lowest sub-level.
-		f := interval.files[0]
-		// Don't bother considering the intervals that are
-		// covered by the seed file since they are likely
-		// nearby. Note that it is possible that those intervals
-		// have seed files at lower sub-levels so could be
-		// viable for compaction.
-		if f == nil {
-			return nil, errors.New("no seed file found in sublevel intervals")
+	filesIncluded.reset(s.levelMetadata.Len())
+	c := s.baseCompactionUsingSeed(f, interval.index, minCompactionDepth, opts, *filesIncluded)
+	if c == nil {
+		return nil, nil
+	}
+	if c.minIntervalIndex < avoidEnd && c.maxIntervalIndex >= avoidStart {
+		// The candidate grew into the avoided key range.
+		return nil, nil
+	}
+	// Check if the chosen compaction overlaps with any files
+	// in Lbase that have Compacting = true. If that's the case,
+	// this compaction cannot be chosen.
+	if s.baseRangesCompacting(c.minIntervalIndex, c.maxIntervalIndex, compactingBase) {
+		return nil, nil
+	}
+	if opts.MergeAdjacentSeeds {
+		s.mergeAdjacentBaseCompactions(c, minCompactionDepth, compactingBase, avoidStart, avoidEnd, opts)
+	}
+	if len(opts.BaseSplitKeys) > 0 {
+		c = s.alignToBaseSplitKeys(c, opts.BaseSplitKeys, compactingBase, avoidStart, avoidEnd, opts)
+	}
+	*filesIncluded = nil
+	return c, nil
+}
+
+// baseFilesCompacting returns true if any of the specified Lbase files that
+// overlap the intervals [minIntervalIndex, maxIntervalIndex] is compacting.
+func (s *L0Sublevels) baseFilesCompacting(
+	minIntervalIndex, maxIntervalIndex int, baseFiles LevelSlice,
+) bool {
+	compacting := false
+	s.visitOverlappingBaseFiles(minIntervalIndex, maxIntervalIndex, baseFiles,
+		func(m *FileMetadata) bool {
+			compacting = m.IsCompacting()
+			return !compacting
+		})
+	return compacting
+}
+
+// compactingBaseRanges holds the key ranges of the compacting files of an
+// Lbase LevelSlice, in increasing key order. Pickers that check many candidates
+// against the same Lbase files collect it once, and then use
+// baseRangesCompacting to binary search it rather than scan Lbase for every
+// candidate.
+type compactingBaseRanges []UserKeyRange
+
+// collectCompactingBaseRanges returns the key ranges of the compacting files in
+// baseFiles.
+func collectCompactingBaseRanges(baseFiles LevelSlice) compactingBaseRanges {
+	var ranges compactingBaseRanges
+	iter := baseFiles.Iter()
+	for m := iter.First(); m != nil; m = iter.Next() {
+		if m.IsCompacting() {
+			ranges = append(ranges, UserKeyRange{Start: m.Smallest.UserKey, End: m.Largest.UserKey})
 		}
-		consideredIntervals.markBits(f.minIntervalIndex, f.maxIntervalIndex+1)
-		if f.IsCompacting() {
-			if f.IsIntraL0Compacting {
-				// If we're picking a base compaction and we came across a
-				// seed file candidate that's being intra-L0 compacted, skip
-				// the interval instead of erroring out.
-				continue
+	}
+	return ranges
+}
+
+// baseRangesCompacting returns the same result as baseFilesCompacting, for the
+// compacting ranges of the Lbase files.
+func (s *L0Sublevels) baseRangesCompacting(
+	minIntervalIndex, maxIntervalIndex int, ranges compactingBaseRanges,
+) bool {
+	// Lbase files don't overlap, so the ranges are sorted by both their start
+	// and their end keys, and the first range ending at or after the start of
+	// the intervals is the only one that needs to be checked.
+	start := s.orderedIntervals[minIntervalIndex].startKey.key
+	i := sort.Search(len(ranges), func(i int) bool {
+		return s.cmp(ranges[i].End, start) >= 0
+	})
+	if i == len(ranges) {
+		return false
+	}
+	end := s.orderedIntervals[maxIntervalIndex+1].startKey
+	cmp := s.cmp(ranges[i].Start, end.key)
+	return cmp < 0 || (cmp == 0 && end.isLargest)
+}
+
+// visitOverlappingBaseFiles calls fn on each of the specified Lbase files that
+// overlap the intervals [minIntervalIndex, maxIntervalIndex], in increasing key
+// order, until fn returns false.
+func (s *L0Sublevels) visitOverlappingBaseFiles(
+	minIntervalIndex, maxIntervalIndex int, baseFiles LevelSlice, fn func(*FileMetadata) bool,
+) {
+	baseIter := baseFiles.Iter()
+	// An interval starting at ImmediateSuccessor(key) can never be the
+	// first interval of a compaction since no file can start at that
+	// interval.
+	m := baseIter.SeekGE(s.cmp, s.orderedIntervals[minIntervalIndex].startKey.key)
+	for ; m != nil; m = baseIter.Next() {
+		cmp := s.cmp(m.Smallest.UserKey, s.orderedIntervals[maxIntervalIndex+1].startKey.key)
+		// Compaction is ending at exclusive bound of maxIntervalIndex+1
+		if cmp > 0 || (cmp == 0 && !s.orderedIntervals[maxIntervalIndex+1].startKey.isLargest) {
+			break
+		}
+		if !fn(m) {
+			return
+		}
+	}
+}
+
+// mergeAdjacentBaseCompactions grows the base compaction c by merging in the
+// base compactions seeded from the nearest non-empty interval on either side
+// of c, if those intervals are at least minCompactionDepth deep. Relieving two
+// neighboring deep intervals in one compaction, rather than in two thin ones,
+// reduces the total number of compactions at the cost of concurrency. A
+// neighbor is only merged if the combined compaction stays within the hard
+// byte limit used when growing candidates, does not grow into the avoided
+// intervals [avoidStart, avoidEnd), and does not overlap compacting Lbase
+// files.
+//
+// The union of two base compactions is also a valid base compaction, since
+// each includes all older files overlapping the files it includes. Neighbors
+// are built with the same options as c.
+func (s *L0Sublevels) mergeAdjacentBaseCompactions(
+	c *L0CompactionFiles,
+	minCompactionDepth int,
+	compactingBase compactingBaseRanges,
+	avoidStart, avoidEnd int,
+	opts L0PickOptions,
+) {
+	// The files of neighbors are reported to opts.OnFileAdded when merged.
+	neighborOpts := opts
+	neighborOpts.OnFileAdded = nil
+	for _, dir := range []int{+1, -1} {
+		i := c.maxIntervalIndex + 1
+		if dir < 0 {
+			i = c.minIntervalIndex - 1
+		}
+		for i >= 0 && i < len(s.orderedIntervals) && len(s.orderedIntervals[i].files) == 0 {
+			i += dir
+		}
+		if i < 0 || i >= len(s.orderedIntervals) {
+			continue
+		}
+		interval := &s.orderedIntervals[i]
+		depth := len(interval.files) - interval.compactingFileCount
+		if interval.isBaseCompacting || depth < minCompactionDepth || interval.files[0].IsCompacting() ||
+			opts.isExcluded(interval.files[0]) {
+			continue
+		}
+		neighbor := s.baseCompactionUsingSeed(interval.files[0], i, minCompactionDepth, neighborOpts, nil /* filesIncluded */)
+		if neighbor == nil {
+			continue
+		}
+		c.filesExamined += neighbor.filesExamined
+		minIntervalIndex, maxIntervalIndex := c.minIntervalIndex, c.maxIntervalIndex
+		if neighbor.minIntervalIndex < minIntervalIndex {
+			minIntervalIndex = neighbor.minIntervalIndex
+		}
+		if neighbor.maxIntervalIndex > maxIntervalIndex {
+			maxIntervalIndex = neighbor.maxIntervalIndex
+		}
+		if minIntervalIndex < avoidEnd && maxIntervalIndex >= avoidStart {
+			continue
+		}
+		if opts.exceedsIntervalSpan(minIntervalIndex, maxIntervalIndex) {
+			continue
+		}
+		fileBytes := c.fileBytes
+		for _, f := range neighbor.Files {
+			if !c.FilesIncluded.Contains(f.L0Index) {
+				fileBytes += f.Size
 			}
-			// We chose a compaction seed file that should not be
-			// compacting. Usually means the score is not accurately
-			// accounting for files already compacting, or internal state is
-			// inconsistent.
-			return nil, errors.Errorf("file %s chosen as seed file for compaction should not be compacting", f.FileNum)
 		}
+		if fileBytes > opts.limits().HardMaxBytes {
+			continue
+		}
+		if s.baseRangesCompacting(minIntervalIndex, maxIntervalIndex, compactingBase) {
+			continue
+		}
+		for _, f := range neighbor.Files {
+			c.addFileFor(f, FileAddedMerge)
+		}
+		if neighbor.seedIntervalMaxLevel > c.seedIntervalMaxLevel {
+			c.seedIntervalMaxLevel = neighbor.seedIntervalMaxLevel
+		}
+	}
+}
 
-		c := s.baseCompactionUsingSeed(f, interval.index, minCompactionDepth)
-		if c != nil {
-			// Check if the chosen compaction overlaps with any files
-			// in Lbase that have Compacting = true. If that's the case,
-			// this compaction cannot be chosen.
-			baseIter := baseFiles.Iter()
-			// An interval starting at ImmediateSuccessor(key) can never be the
-			// first interval of a compaction since no file can start at that
-			// interval.
-			m := baseIter.SeekGE(s.cmp, s.orderedIntervals[c.minIntervalIndex].startKey.key)
-
-			var baseCompacting bool
-			for ; m != nil && !baseCompacting; m = baseIter.Next() {
-				cmp := s.cmp(m.Smallest.UserKey, s.orderedIntervals[c.maxIntervalIndex+1].startKey.key)
-				// Compaction is ending at exclusive bound of c.maxIntervalIndex+1
-				if cmp > 0 || (cmp == 0 && !s.orderedIntervals[c.maxIntervalIndex+1].startKey.isLargest) {
-					break
-				}
-				baseCompacting = baseCompacting || m.IsCompacting()
+// alignToBaseSplitKeys returns the base compaction c, extended to the largest
+// of splitKeys at or before its start, and up to the smallest of splitKeys
+// after its end, if the extended compaction can be picked. Otherwise c is
+// returned as is. The extension only adds files that lie within the split keys,
+// so it never grows the compaction past them, and it isn't picked if it grows
+// the compaction beyond the hard byte limit or the interval span bound of opts.
+func (s *L0Sublevels) alignToBaseSplitKeys(
+	c *L0CompactionFiles,
+	splitKeys [][]byte,
+	compactingBase compactingBaseRanges,
+	avoidStart, avoidEnd int,
+	opts L0PickOptions,
+) *L0CompactionFiles {
+	// splitIntervalIndex returns the index of the first interval that starts
+	// at or after key, i.e. the interval whose start a split at key lines up
+	// with.
+	splitIntervalIndex := func(key []byte) int {
+		ik := intervalKey{key: key}
+		return sort.Search(len(s.orderedIntervals), func(i int) bool {
+			return intervalKeyCompare(s.cmp, s.orderedIntervals[i].startKey, ik) >= 0
+		})
+	}
+	minIntervalIndex, maxIntervalIndex := c.minIntervalIndex, c.maxIntervalIndex
+	for _, key := range splitKeys {
+		index := splitIntervalIndex(key)
+		if index <= c.minIntervalIndex {
+			minIntervalIndex = index
+		} else if index > c.maxIntervalIndex {
+			maxIntervalIndex = index - 1
+			break
+		}
+	}
+	if minIntervalIndex == c.minIntervalIndex && maxIntervalIndex == c.maxIntervalIndex {
+		return c
+	}
+	aligned := c.clone()
+	s.extendCandidateToRectangle(minIntervalIndex, maxIntervalIndex, aligned, true)
+	if aligned.minIntervalIndex < avoidEnd && aligned.maxIntervalIndex >= avoidStart {
+		return c
+	}
+	if aligned.fileBytes > opts.limits().HardMaxBytes ||
+		opts.exceedsIntervalSpan(aligned.minIntervalIndex, aligned.maxIntervalIndex) {
+		return c
+	}
+	if s.baseRangesCompacting(aligned.minIntervalIndex, aligned.maxIntervalIndex, compactingBase) {
+		return c
+	}
+	return aligned
+}
+
+// BuildBaseCompactionForIntervals constructs a base compaction of all the
+// files overlapping the intervals [minIntervalIndex, maxIntervalIndex],
+// regardless of the heuristics used by PickBaseCompaction. This serves manual
+// compactions of a specific part of L0. The interval range of the compaction
+// is widened as necessary to include all older files overlapping the files it
+// includes. An error is returned if the interval range is invalid or does not
+// contain any files, or if a file that would need to be included, or a
+// specified Lbase file overlapping the compaction, is already compacting.
+func (s *L0Sublevels) BuildBaseCompactionForIntervals(
+	minIntervalIndex, maxIntervalIndex int, baseFiles LevelSlice,
+) (*L0CompactionFiles, error) {
+	if minIntervalIndex < 0 || maxIntervalIndex >= len(s.orderedIntervals) ||
+		minIntervalIndex > maxIntervalIndex {
+		return nil, errors.Errorf("invalid interval range [%d, %d] with %d intervals",
+			minIntervalIndex, maxIntervalIndex, len(s.orderedIntervals))
+	}
+	c := &L0CompactionFiles{
+		FilesIncluded:        newBitSet(s.levelMetadata.Len()),
+		seedInterval:         minIntervalIndex,
+		seedIntervalMinLevel: 0,
+		minIntervalIndex:     minIntervalIndex,
+		maxIntervalIndex:     maxIntervalIndex,
+	}
+	// Gather the files from the youngest sublevel down to the oldest one, so
+	// that the older files overlapping the widened interval range of the
+	// compaction are included as well.
+	for sl := len(s.levelFiles) - 1; sl >= 0; sl-- {
+		if !s.extendFiles(sl, math.MaxUint64, math.MaxUint64, c) {
+			return nil, errors.Errorf("file %s overlapping intervals [%d, %d] is already compacting",
+				c.blockingFiles[0].FileNum, minIntervalIndex, maxIntervalIndex)
+		}
+	}
+	if len(c.Files) == 0 {
+		return nil, errors.Errorf("no files overlapping intervals [%d, %d]",
+			minIntervalIndex, maxIntervalIndex)
+	}
+	if s.baseFilesCompacting(c.minIntervalIndex, c.maxIntervalIndex, baseFiles) {
+		return nil, errors.Errorf("Lbase files overlapping intervals [%d, %d] are already compacting",
+			c.minIntervalIndex, c.maxIntervalIndex)
+	}
+	// Use the deepest interval of the requested range as the seed interval.
+	// All files overlapping it are included in the compaction.
+	for i := minIntervalIndex; i <= maxIntervalIndex; i++ {
+		if depth := len(s.orderedIntervals[i].files); depth > c.seedIntervalStackDepthReduction {
+			c.seedInterval = i
+			c.seedIntervalStackDepthReduction = depth
+		}
+	}
+	for _, f := range c.Files {
+		if f.SubLevel > c.seedIntervalMaxLevel {
+			c.seedIntervalMaxLevel = f.SubLevel
+		}
+	}
+	return c, nil
+}
+
+// PlanCompactionsToDepth estimates the sequence of base compactions needed to
+// bring the maximum depth of L0 (excluding files that are already compacting)
+// below targetDepth. It greedily picks a base compaction, removes its files
+// from a simulated copy of L0, and repeats until the target is reached or no
+// further compaction can be picked. The receiver and its files are not
+// mutated. Since the simulation assumes each planned compaction completes
+// before the next one is picked, the returned plan is an approximation of the
+// work the compaction picker will do.
+//
+// The returned candidates reference the receiver's files, and their interval
+// indices are relative to the receiver's intervals.
+func (s *L0Sublevels) PlanCompactionsToDepth(
+	targetDepth int, baseFiles LevelSlice,
+) ([]*L0CompactionFiles, error) {
+	// Copy the file metadata so that the simulation can rebuild sublevels
+	// (which reassigns sublevels and interval indices) without disturbing the
+	// receiver's files.
+	originals := make(map[*FileMetadata]*FileMetadata, s.levelMetadata.Len())
+	files := make([]*FileMetadata, 0, s.levelMetadata.Len())
+	iter := s.levelMetadata.Iter()
+	for f := iter.First(); f != nil; f = iter.Next() {
+		fc := &FileMetadata{}
+		*fc = *f
+		originals[fc] = f
+		files = append(files, fc)
+	}
+
+	var plan []*L0CompactionFiles
+	for {
+		lm := makeLevelMetadata(s.cmp, 0, files)
+		sim, err := NewL0Sublevels(&lm, s.cmp, s.formatKey, 0 /* flushSplitMaxBytes */)
+		if err != nil {
+			return nil, err
+		}
+		sim.InitCompactingFileInfo(nil /* inProgress */)
+		if sim.MaxDepthAfterOngoingCompactions() < targetDepth {
+			return plan, nil
+		}
+		// Mirror the compaction picker, which picks base compactions with a
+		// minimum depth of 1.
+		c, err := sim.PickBaseCompaction(1, baseFiles, L0PickOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if c == nil {
+			return plan, nil
+		}
+
+		// Translate the candidate to reference the receiver's files and
+		// intervals.
+		seedKey := sim.orderedIntervals[c.seedInterval].startKey
+		c.seedInterval = sort.Search(len(s.orderedIntervals), func(i int) bool {
+			return intervalKeyCompare(s.cmp, s.orderedIntervals[i].startKey, seedKey) >= 0
+		})
+		c.FilesIncluded = newBitSet(s.levelMetadata.Len())
+		c.filesAdded = nil
+		c.minIntervalIndex = math.MaxInt32
+		c.maxIntervalIndex = 0
+		for i := range c.Files {
+			c.Files[i] = originals[c.Files[i]]
+			c.FilesIncluded.markBit(c.Files[i].L0Index)
+			if c.Files[i].minIntervalIndex < c.minIntervalIndex {
+				c.minIntervalIndex = c.Files[i].minIntervalIndex
 			}
-			if baseCompacting {
-				continue
+			if c.Files[i].maxIntervalIndex > c.maxIntervalIndex {
+				c.maxIntervalIndex = c.Files[i].maxIntervalIndex
+			}
+		}
+		plan = append(plan, c)
+
+		// Remove the compacted files from the simulated L0.
+		remaining := files[:0]
+		for _, f := range files {
+			if !c.FilesIncluded.Contains(originals[f].L0Index) {
+				remaining = append(remaining, f)
 			}
-			return c, nil
 		}
+		files = remaining
 	}
-	return nil, nil
 }
 
 // Helper function for building an L0 -> Lbase compaction using a seed interval
-// and seed file in that seed interval.
+// and seed file in that seed interval. Of opts, only ClosedRectangles,
+// OnFileAdded and Limits are used. filesIncluded, if non-nil, must be empty and
+// sized for all L0 files, and is used as the FilesIncluded of the compaction.
 func (s *L0Sublevels) baseCompactionUsingSeed(
-	f *FileMetadata, intervalIndex int, minCompactionDepth int,
+	f *FileMetadata,
+	intervalIndex int,
+	minCompactionDepth int,
+	opts L0PickOptions,
+	filesIncluded bitSet,
 ) *L0CompactionFiles {
+	if filesIncluded == nil {
+		filesIncluded = newBitSet(s.levelMetadata.Len())
+	}
 	c := &L0CompactionFiles{
-		FilesIncluded:        newBitSet(s.levelMetadata.Len()),
+		FilesIncluded:        filesIncluded,
 		seedInterval:         intervalIndex,
 		seedIntervalMinLevel: 0,
 		minIntervalIndex:     f.minIntervalIndex,
 		maxIntervalIndex:     f.maxIntervalIndex,
+		onFileAdded:          opts.OnFileAdded,
+		excluded:             opts.excluded,
 	}
-	c.addFile(f)
+	c.addFileFor(f, FileAddedSeed)
 
 	// The first iteration of this loop builds the compaction at the seed file's
 	// sublevel. Future iterations expand on this compaction by stacking
@@ -1464,9 +4750,14 @@ func (s *L0Sublevels) baseCompactionUsingSeed(
 	for i := 0; i < len(interval.files); i++ {
 		f2 := interval.files[i]
 		sl := f2.SubLevel
+		c.filesExamined++
+		if c.isExcluded(f2) {
+			// f2 is excluded, and so are the files stacked above it.
+			break
+		}
 		c.seedIntervalStackDepthReduction++
 		c.seedIntervalMaxLevel = sl
-		c.addFile(f2)
+		c.addFileFor(f2, FileAddedStacking)
 		// The seed file is in the lowest sublevel in the seed interval, but it may
 		// overlap with other files in even lower sublevels. For
 		// correctness we need to grow our interval to include those files, and
@@ -1492,7 +4783,7 @@ func (s *L0Sublevels) baseCompactionUsingSeed(
 		// for non-L0 compactions.
 		done := false
 		for currLevel := sl - 1; currLevel >= 0; currLevel-- {
-			if !s.extendFiles(currLevel, math.MaxUint64, c) {
+			if !s.extendFiles(currLevel, math.MaxUint64, math.MaxUint64, c) {
 				// Failed to extend due to ongoing compaction.
 				done = true
 				break
@@ -1501,30 +4792,44 @@ func (s *L0Sublevels) baseCompactionUsingSeed(
 		if done {
 			break
 		}
+		if opts.ClosedRectangles && (c.minIntervalIndex < f.minIntervalIndex || c.maxIntervalIndex > f.maxIntervalIndex) {
+			// The compaction would no longer be a closed rectangle.
+			break
+		}
+		if opts.exceedsIntervalSpan(c.minIntervalIndex, c.maxIntervalIndex) {
+			break
+		}
+		if s.tooManyCompactionFiles(c) {
+			break
+		}
 		// Observed some compactions using > 1GB from L0 in an import
 		// experiment. Very long running compactions are not great as they
 		// reduce concurrency while they run, and take a while to produce
 		// results, though they're sometimes unavoidable. There is a tradeoff
 		// here in that adding more depth is more efficient in reducing stack
 		// depth, but long running compactions reduce flexibility in what can
-		// run concurrently in L0 and even Lbase -> Lbase+1. An increase more
-		// than 150% in bytes since the last candidate compaction (along with a
-		// total compaction size in excess of 100mb), or a total compaction
-		// size beyond a hard limit of 500mb, is criteria for rejecting this
-		// candidate. This lets us prefer slow growths as we add files, while
-		// still having a hard limit. Note that if this is the first compaction
-		// candidate to reach a stack depth reduction of minCompactionDepth or
-		// higher, this candidate will be chosen regardless.
+		// run concurrently in L0 and even Lbase -> Lbase+1. By default, an
+		// increase more than 150% in bytes since the last candidate compaction
+		// (along with a total compaction size in excess of 100mb), or a total
+		// compaction size beyond a hard limit of 500mb, is criteria for
+		// rejecting this candidate, see L0CompactionLimits. This lets us
+		// prefer slow growths as we add files, while still having a hard
+		// limit. Note that if this is the first compaction candidate to reach
+		// a stack depth reduction of minCompactionDepth or higher, this
+		// candidate will be chosen regardless.
 		if lastCandidate == nil {
 			lastCandidate = &L0CompactionFiles{}
 		} else if lastCandidate.seedIntervalStackDepthReduction >= minCompactionDepth &&
-			c.fileBytes > 100<<20 &&
-			(float64(c.fileBytes)/float64(lastCandidate.fileBytes) > 1.5 || c.fileBytes > 500<<20) {
+			opts.limits().stopGrowth(c, lastCandidate) {
 			break
 		}
 		*lastCandidate = *c
 	}
 	if lastCandidate != nil && lastCandidate.seedIntervalStackDepthReduction >= minCompactionDepth {
+		// Account for files examined by any unsuccessful attempts to grow
+		// lastCandidate.
+		lastCandidate.filesExamined = c.filesExamined
+		lastCandidate.blockingFiles = c.blockingFiles
 		lastCandidate.FilesIncluded.clearAllBits()
 		for _, f := range lastCandidate.Files {
 			lastCandidate.FilesIncluded.markBit(f.L0Index)
@@ -1534,22 +4839,34 @@ func (s *L0Sublevels) baseCompactionUsingSeed(
 	return nil
 }
 
+// tooManyCompactionFiles returns true if the candidate c has more files than
+// opts.MaxCompactionFiles allows.
+func (s *L0Sublevels) tooManyCompactionFiles(c *L0CompactionFiles) bool {
+	return s.opts.MaxCompactionFiles > 0 && len(c.Files) > s.opts.MaxCompactionFiles
+}
+
 // Expands fields in the provided L0CompactionFiles instance (cFiles) to
 // include overlapping files in the specified sublevel. Returns true if the
 // compaction is possible (i.e. does not conflict with any base/intra-L0
-// compacting files).
+// compacting files, and doesn't need to include files larger than
+// maxFileSize).
 func (s *L0Sublevels) extendFiles(
-	sl int, earliestUnflushedSeqNum uint64, cFiles *L0CompactionFiles,
+	sl int, earliestUnflushedSeqNum uint64, maxFileSize uint64, cFiles *L0CompactionFiles,
 ) bool {
-	index := sort.Search(len(s.levelFiles[sl]), func(i int) bool {
-		return s.levelFiles[sl][i].maxIntervalIndex >= cFiles.minIntervalIndex
-	})
-	for ; index < len(s.levelFiles[sl]); index++ {
-		f := s.levelFiles[sl][index]
-		if f.minIntervalIndex > cFiles.maxIntervalIndex {
-			break
-		}
-		if f.IsCompacting() {
+	// Files within a sublevel never share an interval, so adding a file to
+	// cFiles below cannot widen its interval range to overlap more files in
+	// this sublevel.
+	files := s.FilesInSublevelOverlappingIntervals(sl, cFiles.minIntervalIndex, cFiles.maxIntervalIndex)
+	for i, f := range files {
+		cFiles.filesExamined++
+		if cFiles.unavailable(f) {
+			// Record the compacting or excluded files in this sublevel that
+			// prevent the compaction from growing, for BlockingFiles.
+			for _, f := range files[i:] {
+				if cFiles.unavailable(f) {
+					cFiles.blockingFiles = append(cFiles.blockingFiles, f)
+				}
+			}
 			return false
 		}
 		// Skip over files that are newer than earliestUnflushedSeqNum. This is
@@ -1561,18 +4878,46 @@ func (s *L0Sublevels) extendFiles(
 		if f.LargestSeqNum >= earliestUnflushedSeqNum {
 			continue
 		}
-		cFiles.addFile(f)
+		if f.Size > maxFileSize {
+			return false
+		}
+		cFiles.addFileFor(f, FileAddedOverlap)
 	}
 	return true
 }
 
+// FilesInSublevelOverlappingIntervals returns the files in sublevel sl that
+// overlap the intervals with indices [minIntervalIndex, maxIntervalIndex], in
+// increasing key order. The returned slice must not be modified.
+func (s *L0Sublevels) FilesInSublevelOverlappingIntervals(
+	sl, minIntervalIndex, maxIntervalIndex int,
+) []*FileMetadata {
+	files := s.levelFiles[sl]
+	start := sort.Search(len(files), func(i int) bool {
+		return files[i].maxIntervalIndex >= minIntervalIndex
+	})
+	end := start + sort.Search(len(files)-start, func(i int) bool {
+		return files[start+i].minIntervalIndex > maxIntervalIndex
+	})
+	return files[start:end:end]
+}
+
 // PickIntraL0Compaction picks an intra-L0 compaction for files in this
 // sublevel. This method is only called when a base compaction cannot be chosen.
 // See comment above PickBaseCompaction for heuristics involved in this
-// selection.
+// selection. If the number of sublevels exceeds opts.MaxSublevels,
+// minCompactionDepth is lowered to pick compactions more aggressively.
 func (s *L0Sublevels) PickIntraL0Compaction(
-	earliestUnflushedSeqNum uint64, minCompactionDepth int,
+	earliestUnflushedSeqNum uint64, minCompactionDepth int, opts L0PickOptions,
 ) (*L0CompactionFiles, error) {
+	if err := checkMinCompactionDepth(minCompactionDepth); err != nil {
+		return nil, err
+	}
+	if err := opts.Limits.validate(); err != nil {
+		return nil, err
+	}
+	minCompactionDepth = s.intraL0MinDepth(minCompactionDepth, opts)
+	opts = s.withExcluded(opts)
 	scoredIntervals := make([]intervalAndScore, len(s.orderedIntervals))
 	for i := range s.orderedIntervals {
 		interval := &s.orderedIntervals[i]
@@ -1580,7 +4925,14 @@ func (s *L0Sublevels) PickIntraL0Compaction(
 		if minCompactionDepth > depth {
 			continue
 		}
-		scoredIntervals[i] = intervalAndScore{interval: i, score: depth}
+		scoredIntervals[i] = intervalAndScore{
+			interval: i, score: depth, bytes: tiebreakBytes(interval, opts.ByteTiebreak),
+		}
+		if opts.PreferFlushSplitAlignment {
+			// The seed file is the newest file in the interval, unless it
+			// can't be compacted yet.
+			scoredIntervals[i].misaligned = s.straddlesFlushSplitKey(interval.files[len(interval.files)-1])
+		}
 	}
 	sort.Sort(intervalSorterByDecreasingScore(scoredIntervals))
 
@@ -1590,7 +4942,7 @@ func (s *L0Sublevels) PickIntraL0Compaction(
 	consideredIntervals := newBitSet(len(s.orderedIntervals))
 	for _, scoredInterval := range scoredIntervals {
 		interval := &s.orderedIntervals[scoredInterval.interval]
-		if consideredIntervals[interval.index] {
+		if consideredIntervals.Contains(interval.index) {
 			continue
 		}
 
@@ -1600,7 +4952,7 @@ func (s *L0Sublevels) PickIntraL0Compaction(
 		stackDepthReduction := scoredInterval.score
 		for i := len(interval.files) - 1; i >= 0; i-- {
 			f = interval.files[i]
-			if f.IsCompacting() {
+			if f.IsCompacting() || opts.isExcluded(f) {
 				break
 			}
 			consideredIntervals.markBits(f.minIntervalIndex, f.maxIntervalIndex+1)
@@ -1624,15 +4976,15 @@ func (s *L0Sublevels) PickIntraL0Compaction(
 		if f == nil {
 			return nil, errors.New("no seed file found in sublevel intervals")
 		}
-		if f.IsCompacting() {
-			// This file could be in a concurrent intra-L0 or base compaction.
-			// Try another interval.
+		if f.IsCompacting() || opts.isExcluded(f) {
+			// This file could be in a concurrent intra-L0 or base compaction,
+			// or be excluded. Try another interval.
 			continue
 		}
 
 		// We have a seed file. Build a compaction off of that seed.
 		c := s.intraL0CompactionUsingSeed(
-			f, interval.index, earliestUnflushedSeqNum, minCompactionDepth)
+			f, interval.index, earliestUnflushedSeqNum, minCompactionDepth, opts)
 		if c != nil {
 			return c, nil
 		}
@@ -1640,8 +4992,144 @@ func (s *L0Sublevels) PickIntraL0Compaction(
 	return nil, nil
 }
 
+// PickSmallFileIntraL0Compaction picks an intra-L0 compaction that only
+// includes files of at most maxFileSize bytes, and includes at least minFiles
+// files. Such a compaction consolidates many small files, as left behind by
+// bulk ingestion, into fewer larger ones, reducing the L0 file count without
+// rewriting large files. The seed interval is the one with the most such files
+// that aren't compacting. Files with a LargestSeqNum of
+// earliestUnflushedSeqNum or higher are excluded, as in PickIntraL0Compaction.
+// The compaction stops growing beyond limits.HardMaxBytes; nil limits use the
+// defaults. Returns nil if no such compaction is possible.
+func (s *L0Sublevels) PickSmallFileIntraL0Compaction(
+	earliestUnflushedSeqNum uint64, maxFileSize uint64, minFiles int, limits *L0CompactionLimits,
+) (*L0CompactionFiles, error) {
+	if minFiles < 1 {
+		return nil, errors.Errorf("pebble: minFiles must be at least 1, got %d", minFiles)
+	}
+	if err := limits.validate(); err != nil {
+		return nil, err
+	}
+	if limits == nil {
+		limits = &defaultL0CompactionLimits
+	}
+	scoredIntervals := make([]intervalAndScore, 0, len(s.orderedIntervals))
+	for i := range s.orderedIntervals {
+		count := 0
+		for _, f := range s.orderedIntervals[i].files {
+			if !f.IsCompacting() && f.Size <= maxFileSize && f.LargestSeqNum < earliestUnflushedSeqNum {
+				count++
+			}
+		}
+		if count > 0 {
+			scoredIntervals = append(scoredIntervals, intervalAndScore{interval: i, score: count})
+		}
+	}
+	sort.Sort(intervalSorterByDecreasingScore(scoredIntervals))
+
+	consideredIntervals := newBitSet(len(s.orderedIntervals))
+	for _, scoredInterval := range scoredIntervals {
+		interval := &s.orderedIntervals[scoredInterval.interval]
+		if consideredIntervals.Contains(interval.index) {
+			continue
+		}
+		// The seed file is the youngest file in the interval that can be
+		// compacted. Since the compaction must include all younger overlapping
+		// files, it can't include any file of the interval if the seed file is
+		// compacting or too large.
+		var f *FileMetadata
+		for i := len(interval.files) - 1; i >= 0; i-- {
+			if interval.files[i].LargestSeqNum < earliestUnflushedSeqNum {
+				f = interval.files[i]
+				break
+			}
+		}
+		if f == nil || f.IsCompacting() || f.Size > maxFileSize {
+			continue
+		}
+		consideredIntervals.markBits(f.minIntervalIndex, f.maxIntervalIndex+1)
+		c := s.smallFileIntraL0CompactionUsingSeed(
+			f, interval.index, earliestUnflushedSeqNum, maxFileSize, limits)
+		if c != nil && len(c.Files) >= minFiles {
+			return c, nil
+		}
+	}
+	return nil, nil
+}
+
+// smallFileIntraL0CompactionUsingSeed builds an intra-L0 compaction of files
+// of at most maxFileSize bytes off of the seed file f, by stacking older files
+// of the seed interval as in intraL0CompactionUsingSeed, until a file is too
+// large or compacting, or the compaction grows beyond limits.HardMaxBytes.
+// Returns nil if no compaction can be built.
+func (s *L0Sublevels) smallFileIntraL0CompactionUsingSeed(
+	f *FileMetadata,
+	intervalIndex int,
+	earliestUnflushedSeqNum uint64,
+	maxFileSize uint64,
+	limits *L0CompactionLimits,
+) *L0CompactionFiles {
+	c := &L0CompactionFiles{
+		FilesIncluded:           newBitSet(s.levelMetadata.Len()),
+		seedInterval:            intervalIndex,
+		seedIntervalMaxLevel:    len(s.levelFiles) - 1,
+		minIntervalIndex:        f.minIntervalIndex,
+		maxIntervalIndex:        f.maxIntervalIndex,
+		isIntraL0:               true,
+		earliestUnflushedSeqNum: earliestUnflushedSeqNum,
+	}
+	c.addFile(f)
+
+	var lastCandidate *L0CompactionFiles
+	interval := &s.orderedIntervals[intervalIndex]
+	slIndex := len(interval.files) - 1
+	for interval.files[slIndex] != f {
+		slIndex--
+	}
+	for ; slIndex >= 0; slIndex-- {
+		f2 := interval.files[slIndex]
+		c.filesExamined++
+		if f2.IsCompacting() || f2.Size > maxFileSize {
+			break
+		}
+		c.seedIntervalStackDepthReduction++
+		c.seedIntervalMinLevel = f2.SubLevel
+		c.addFile(f2)
+		// As in intraL0CompactionUsingSeed, all younger files overlapping the
+		// compaction must be included.
+		done := false
+		for currLevel := f2.SubLevel + 1; currLevel < len(s.levelFiles); currLevel++ {
+			if !s.extendFiles(currLevel, earliestUnflushedSeqNum, maxFileSize, c) {
+				done = true
+				break
+			}
+		}
+		if done || c.fileBytes > limits.HardMaxBytes || s.tooManyCompactionFiles(c) {
+			break
+		}
+		if lastCandidate == nil {
+			lastCandidate = &L0CompactionFiles{}
+		}
+		*lastCandidate = *c
+	}
+	if lastCandidate == nil {
+		return nil
+	}
+	lastCandidate.filesExamined = c.filesExamined
+	lastCandidate.blockingFiles = c.blockingFiles
+	lastCandidate.FilesIncluded.clearAllBits()
+	for _, f := range lastCandidate.Files {
+		lastCandidate.FilesIncluded.markBit(f.L0Index)
+	}
+	return lastCandidate
+}
+
 func (s *L0Sublevels) intraL0CompactionUsingSeed(
-	f *FileMetadata, intervalIndex int, earliestUnflushedSeqNum uint64, minCompactionDepth int,
+	f *FileMetadata,
+	intervalIndex int,
+	earliestUnflushedSeqNum uint64,
+	minCompactionDepth int,
+	opts L0PickOptions,
 ) *L0CompactionFiles {
 	// We know that all the files that overlap with intervalIndex have
 	// LargestSeqNum < earliestUnflushedSeqNum, but for other intervals
@@ -1655,8 +5143,10 @@ func (s *L0Sublevels) intraL0CompactionUsingSeed(
 		maxIntervalIndex:        f.maxIntervalIndex,
 		isIntraL0:               true,
 		earliestUnflushedSeqNum: earliestUnflushedSeqNum,
+		onFileAdded:             opts.OnFileAdded,
+		excluded:                opts.excluded,
 	}
-	c.addFile(f)
+	c.addFileFor(f, FileAddedSeed)
 
 	var lastCandidate *L0CompactionFiles
 	interval := &s.orderedIntervals[intervalIndex]
@@ -1676,12 +5166,13 @@ func (s *L0Sublevels) intraL0CompactionUsingSeed(
 	for ; slIndex >= 0; slIndex-- {
 		f2 := interval.files[slIndex]
 		sl := f2.SubLevel
-		if f2.IsCompacting() {
+		c.filesExamined++
+		if c.unavailable(f2) {
 			break
 		}
 		c.seedIntervalStackDepthReduction++
 		c.seedIntervalMinLevel = sl
-		c.addFile(f2)
+		c.addFileFor(f2, FileAddedStacking)
 		// The seed file captures all files in the higher level that fall in the
 		// range of intervals. That may extend the range of intervals so for
 		// correctness we need to capture all files in the next higher level that
@@ -1703,25 +5194,28 @@ func (s *L0Sublevels) intraL0CompactionUsingSeed(
 		// We assume that the performance concern is not a practical issue.
 		done := false
 		for currLevel := sl + 1; currLevel < len(s.levelFiles); currLevel++ {
-			if !s.extendFiles(currLevel, earliestUnflushedSeqNum, c) {
+			if !s.extendFiles(currLevel, earliestUnflushedSeqNum, math.MaxUint64, c) {
 				// Failed to extend due to ongoing compaction.
 				done = true
 				break
 			}
 		}
-		if done {
+		if done || s.tooManyCompactionFiles(c) {
 			break
 		}
 		if lastCandidate == nil {
 			lastCandidate = &L0CompactionFiles{}
 		} else if lastCandidate.seedIntervalStackDepthReduction >= minCompactionDepth &&
-			c.fileBytes > 100<<20 &&
-			(float64(c.fileBytes)/float64(lastCandidate.fileBytes) > 1.5 || c.fileBytes > 500<<20) {
+			opts.limits().stopGrowth(c, lastCandidate) {
 			break
 		}
 		*lastCandidate = *c
 	}
 	if lastCandidate != nil && lastCandidate.seedIntervalStackDepthReduction >= minCompactionDepth {
+		// Account for files examined by any unsuccessful attempts to grow
+		// lastCandidate.
+		lastCandidate.filesExamined = c.filesExamined
+		lastCandidate.blockingFiles = c.blockingFiles
 		lastCandidate.FilesIncluded.clearAllBits()
 		for _, f := range lastCandidate.Files {
 			lastCandidate.FilesIncluded.markBit(f.L0Index)
@@ -1733,6 +5227,18 @@ func (s *L0Sublevels) intraL0CompactionUsingSeed(
 	return nil
 }
 
+// CanExtendForBaseCompactionTo returns whether ExtendL0ForBaseCompactionTo
+// would add any files to the specified base compaction candidate, without
+// modifying the candidate. This lets a caller decide whether to wait for a
+// larger compaction before committing to the candidate.
+func (s *L0Sublevels) CanExtendForBaseCompactionTo(
+	smallest, largest InternalKey, candidate *L0CompactionFiles,
+) bool {
+	c := candidate.clone()
+	c.onFileAdded = nil
+	return s.ExtendL0ForBaseCompactionTo(smallest, largest, c)
+}
+
 // ExtendL0ForBaseCompactionTo extends the specified base compaction candidate
 // L0CompactionFiles to optionally cover more files in L0 without "touching"
 // any of the passed-in keys (i.e. the smallest/largest bounds are exclusive),
@@ -1903,6 +5409,7 @@ func (s *L0Sublevels) extendCandidateToRectangle(
 			if f.minIntervalIndex > maxIntervalIndex {
 				break
 			}
+			candidate.filesExamined++
 			include := true
 			// Extends out on the left so can't be included. This narrows
 			// what we can included in the next level.
@@ -1946,7 +5453,7 @@ func (s *L0Sublevels) extendCandidateToRectangle(
 		candidateHasAlreadyPickedFiles := false
 		for index = firstIndex; index <= lastIndex; index++ {
 			f := files[index]
-			if f.IsCompacting() {
+			if candidate.unavailable(f) {
 				if nonCompactingFirst != -1 {
 					last := index - 1
 					// Prioritize runs of consecutive non-compacting files that
@@ -1970,7 +5477,7 @@ func (s *L0Sublevels) extendCandidateToRectangle(
 			if nonCompactingFirst == -1 {
 				nonCompactingFirst = index
 			}
-			if candidate.FilesIncluded[f.L0Index] {
+			if candidate.FilesIncluded.Contains(f.L0Index) {
 				currentRunHasAlreadyPickedFiles = true
 			}
 		}
@@ -1998,17 +5505,25 @@ func (s *L0Sublevels) extendCandidateToRectangle(
 		}
 		for index := candidateNonCompactingFirst; index <= candidateNonCompactingLast; index++ {
 			f := files[index]
-			if f.IsCompacting() {
+			if candidate.unavailable(f) {
 				// TODO(bilal): Do a logger.Fatalf instead of a panic, for
 				// cleaner unwinding and error messages.
-				panic(fmt.Sprintf("expected %s to not be compacting", f.FileNum))
+				panic(fmt.Sprintf("expected %s to not be compacting or excluded", f.FileNum))
 			}
 			if candidate.isIntraL0 && f.LargestSeqNum >= candidate.earliestUnflushedSeqNum {
 				continue
 			}
-			if !candidate.FilesIncluded[f.L0Index] {
+			if !candidate.FilesIncluded.Contains(f.L0Index) {
+				if s.opts.MaxCompactionFiles > 0 && len(candidate.Files) >= s.opts.MaxCompactionFiles {
+					// Stop extending the candidate. Files added so far are
+					// safe to include: the files of lower sublevels for a base
+					// compaction, or of higher sublevels for an intra-L0
+					// compaction, that they overlap within the rectangle are
+					// included already.
+					return addedCount > 0
+				}
 				addedCount++
-				candidate.addFile(f)
+				candidate.addFileFor(f, FileAddedRectangle)
 			}
 		}
 	}
@@ -6,10 +6,12 @@ package manifest
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"math"
 	"os"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
@@ -57,6 +59,44 @@ func readManifest(filename string) (*Version, error) {
 	return v, nil
 }
 
+// parseL0CompactionLimits parses a limits=(min_growth_bytes,growth_ratio,hard_max_bytes)
+// datadriven argument.
+func parseL0CompactionLimits(t *testing.T, arg datadriven.CmdArg) *L0CompactionLimits {
+	if len(arg.Vals) != 3 {
+		t.Fatalf("expected limits=(min_growth_bytes,growth_ratio,hard_max_bytes)")
+	}
+	var limits L0CompactionLimits
+	var err error
+	limits.MinGrowthBytes, err = strconv.ParseUint(arg.Vals[0], 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits.GrowthRatio, err = strconv.ParseFloat(arg.Vals[1], 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits.HardMaxBytes, err = strconv.ParseUint(arg.Vals[2], 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &limits
+}
+
+// newTestFile returns an L0 file spanning the user keys [smallest, largest],
+// with a single sequence number.
+func newTestFile(fileNum base.FileNum, smallest, largest string, seqNum, size uint64) *FileMetadata {
+	return (&FileMetadata{
+		FileNum:        fileNum,
+		Size:           size,
+		SmallestSeqNum: seqNum,
+		LargestSeqNum:  seqNum,
+	}).ExtendPointKeyBounds(
+		base.DefaultComparer.Compare,
+		base.MakeInternalKey([]byte(smallest), seqNum, base.InternalKeyKindSet),
+		base.MakeInternalKey([]byte(largest), seqNum, base.InternalKeyKindSet),
+	)
+}
+
 func TestL0Sublevels_LargeImportL0(t *testing.T) {
 	// TODO(bilal): Fix this test.
 	t.Skip()
@@ -69,7 +109,7 @@ func TestL0Sublevels_LargeImportL0(t *testing.T) {
 	fmt.Printf("L0Sublevels:\n%s\n\n", sublevels)
 
 	for i := 0; ; i++ {
-		c, err := sublevels.PickBaseCompaction(2, LevelSlice{})
+		c, err := sublevels.PickBaseCompaction(2, LevelSlice{}, L0PickOptions{})
 		require.NoError(t, err)
 		if c == nil {
 			break
@@ -78,7 +118,7 @@ func TestL0Sublevels_LargeImportL0(t *testing.T) {
 			i, len(c.Files), c.fileBytes, c.minIntervalIndex, c.maxIntervalIndex, c.seedIntervalStackDepthReduction)
 		var files []*FileMetadata
 		for i := range c.Files {
-			if c.FilesIncluded[i] {
+			if c.FilesIncluded.Contains(i) {
 				c.Files[i].CompactionState = CompactionStateCompacting
 				files = append(files, c.Files[i])
 			}
@@ -88,7 +128,7 @@ func TestL0Sublevels_LargeImportL0(t *testing.T) {
 	}
 
 	for i := 0; ; i++ {
-		c, err := sublevels.PickIntraL0Compaction(math.MaxUint64, 2)
+		c, err := sublevels.PickIntraL0Compaction(math.MaxUint64, 2, L0PickOptions{})
 		require.NoError(t, err)
 		if c == nil {
 			break
@@ -97,7 +137,7 @@ func TestL0Sublevels_LargeImportL0(t *testing.T) {
 			i, len(c.Files), c.fileBytes, c.minIntervalIndex, c.maxIntervalIndex, c.seedIntervalStackDepthReduction)
 		var files []*FileMetadata
 		for i := range c.Files {
-			if c.FilesIncluded[i] {
+			if c.FilesIncluded.Contains(i) {
 				c.Files[i].CompactionState = CompactionStateCompacting
 				c.Files[i].IsIntraL0Compacting = true
 				files = append(files, c.Files[i])
@@ -130,7 +170,7 @@ func visualizeSublevels(
 			buf.WriteByte(f.Smallest.UserKey[0])
 			middleChar := byte('-')
 			if isL0 {
-				if compactionFiles[f.L0Index] {
+				if compactionFiles.Contains(f.L0Index) {
 					middleChar = '+'
 				} else if f.IsCompacting() {
 					if f.IsIntraL0Compacting {
@@ -147,7 +187,7 @@ func visualizeSublevels(
 			}
 			if f.Smallest.UserKey[0] == f.Largest.UserKey[0] {
 				buf.WriteByte(f.Largest.UserKey[0])
-				if compactionFiles[f.L0Index] {
+				if compactionFiles.Contains(f.L0Index) {
 					buf.WriteByte('+')
 				} else if j < len(files)-1 {
 					buf.WriteByte(' ')
@@ -248,6 +288,11 @@ func TestL0Sublevels(t *testing.T) {
 						return nil, err
 					}
 					m.Size = uint64(sizeInt)
+				case "created":
+					m.CreationTime, err = strconv.ParseInt(parts[1], 10, 64)
+					if err != nil {
+						return nil, err
+					}
 				}
 			}
 		}
@@ -320,6 +365,7 @@ func TestL0Sublevels(t *testing.T) {
 
 			flushSplitMaxBytes := 64
 			initialize := true
+			var opts L0SublevelsOptions
 			for _, arg := range td.CmdArgs {
 				switch arg.Key {
 				case "flush_split_max_bytes":
@@ -327,6 +373,30 @@ func TestL0Sublevels(t *testing.T) {
 					if err != nil {
 						t.Fatal(err)
 					}
+				case "flush_split_target_bytes":
+					opts.FlushSplitTargetBytes, err = strconv.ParseInt(arg.Vals[0], 10, 64)
+					if err != nil {
+						t.Fatal(err)
+					}
+				case "min_split_interval_bytes":
+					opts.MinSplitIntervalBytes, err = strconv.ParseInt(arg.Vals[0], 10, 64)
+					if err != nil {
+						t.Fatal(err)
+					}
+				case "flush_split_policy":
+					switch arg.Vals[0] {
+					case "scale_by_sublevels":
+						opts.FlushSplitPolicy = FlushSplitScaleBySublevels
+					case "fixed":
+						opts.FlushSplitPolicy = FlushSplitFixed
+					default:
+						t.Fatalf("unknown flush split policy %q", arg.Vals[0])
+					}
+				case "max_compaction_files":
+					opts.MaxCompactionFiles, err = strconv.Atoi(arg.Vals[0])
+					if err != nil {
+						t.Fatal(err)
+					}
 				case "no_initialize":
 					// This case is for use with explicitly-specified sublevels
 					// only.
@@ -348,13 +418,15 @@ func TestL0Sublevels(t *testing.T) {
 					if sublevels != nil && sublevels2 != nil {
 						require.Equal(t, sublevels.flushSplitUserKeys, sublevels2.flushSplitUserKeys)
 						require.Equal(t, sublevels.levelFiles, sublevels2.levelFiles)
+						require.True(t, sublevels.Equal(sublevels2))
 					}
 				} else {
-					sublevels, err = NewL0Sublevels(
+					sublevels, err = NewL0SublevelsWithOptions(
 						&levelMetadata,
 						base.DefaultComparer.Compare,
 						base.DefaultFormatter,
-						int64(flushSplitMaxBytes))
+						int64(flushSplitMaxBytes),
+						opts)
 				}
 				if err != nil {
 					return err.Error()
@@ -388,8 +460,95 @@ func TestL0Sublevels(t *testing.T) {
 		case "pick-intra-l0-compaction":
 			minCompactionDepth := 3
 			earliestUnflushedSeqNum := uint64(math.MaxUint64)
+			var opts L0PickOptions
+			var trace strings.Builder
 			for _, arg := range td.CmdArgs {
 				switch arg.Key {
+				case "trace":
+					opts.OnFileAdded = func(f *FileMetadata, reason FileAddedReason) {
+						fmt.Fprintf(&trace, " %s:%s", f.FileNum, reason)
+					}
+				case "avoid":
+					opts.Avoid = &UserKeyRange{
+						Start: []byte(arg.Vals[0]),
+						End:   []byte(arg.Vals[1]),
+					}
+				case "prioritize_deepest":
+					opts.PrioritizeDeepest = true
+				case "excluded":
+					for _, val := range arg.Vals {
+						fileNum, err := strconv.ParseUint(val, 10, 64)
+						if err != nil {
+							t.Fatal(err)
+						}
+						for _, f := range fileMetas[0] {
+							if f.FileNum == base.FileNum(fileNum) {
+								opts.Excluded = append(opts.Excluded, f)
+							}
+						}
+					}
+				case "merge_adjacent":
+					opts.MergeAdjacentSeeds = true
+				case "created_before":
+					opts.CreatedBefore, err = strconv.ParseInt(arg.Vals[0], 10, 64)
+					if err != nil {
+						t.Fatal(err)
+					}
+				case "byte_tiebreak":
+					switch arg.Vals[0] {
+					case "heavier":
+						opts.ByteTiebreak = IntervalByteTiebreakHeavier
+					case "lighter":
+						opts.ByteTiebreak = IntervalByteTiebreakLighter
+					default:
+						t.Fatalf("unknown byte tiebreak %q", arg.Vals[0])
+					}
+				case "centered_file_radius":
+					opts.CenteredFileRadius, err = strconv.Atoi(arg.Vals[0])
+					if err != nil {
+						t.Fatal(err)
+					}
+				case "closed_rectangles":
+					opts.ClosedRectangles = true
+				case "max_interval_span":
+					opts.MaxIntervalSpan, err = strconv.Atoi(arg.Vals[0])
+					if err != nil {
+						return err.Error()
+					}
+				case "wide_seed_file_bonus":
+					opts.WideSeedFileBonus, err = strconv.Atoi(arg.Vals[0])
+					if err != nil {
+						t.Fatal(err)
+					}
+				case "wide_seed_file_min_intervals":
+					opts.WideSeedFileMinIntervals, err = strconv.Atoi(arg.Vals[0])
+					if err != nil {
+						t.Fatal(err)
+					}
+				case "interval_scorer":
+					switch arg.Vals[0] {
+					case "default":
+						opts.IntervalScorer = DefaultIntervalScorer
+					case "shallowest":
+						opts.IntervalScorer = func(interval L0IntervalInfo, _ int) int {
+							return interval.CompactingFileCount - interval.FileCount
+						}
+					default:
+						t.Fatalf("unknown interval scorer %q", arg.Vals[0])
+					}
+				case "prefer_flush_split_alignment":
+					opts.PreferFlushSplitAlignment = true
+				case "limits":
+					opts.Limits = parseL0CompactionLimits(t, arg)
+				case "base_split_keys":
+					for _, key := range arg.Vals {
+						opts.BaseSplitKeys = append(opts.BaseSplitKeys, []byte(key))
+					}
+				case "max_sublevels":
+					opts.MaxSublevels, err = strconv.Atoi(arg.Vals[0])
+					if err != nil {
+						t.Fatal(err)
+					}
 				case "min_depth":
 					minCompactionDepth, err = strconv.Atoi(arg.Vals[0])
 					if err != nil {
@@ -407,7 +566,7 @@ func TestL0Sublevels(t *testing.T) {
 			var lcf *L0CompactionFiles
 			if pickBaseCompaction {
 				baseFiles := NewLevelSliceKeySorted(base.DefaultComparer.Compare, fileMetas[baseLevel])
-				lcf, err = sublevels.PickBaseCompaction(minCompactionDepth, baseFiles)
+				lcf, err = sublevels.PickBaseCompaction(minCompactionDepth, baseFiles, opts)
 				if err == nil && lcf != nil {
 					// Try to extend the base compaction into a more rectangular
 					// shape, using the smallest/largest keys of the files before
@@ -428,13 +587,19 @@ func TestL0Sublevels(t *testing.T) {
 					if lastFile < len(baseFiles) {
 						endKey = baseFiles[lastFile].Smallest
 					}
-					sublevels.ExtendL0ForBaseCompactionTo(
+					// The dry run must predict the outcome of the extension
+					// without modifying the candidate.
+					fileCount := len(lcf.Files)
+					canExtend := sublevels.CanExtendForBaseCompactionTo(startKey, endKey, lcf)
+					require.Equal(t, fileCount, len(lcf.Files))
+					extended := sublevels.ExtendL0ForBaseCompactionTo(
 						startKey,
 						endKey,
 						lcf)
+					require.Equal(t, extended, canExtend)
 				}
 			} else {
-				lcf, err = sublevels.PickIntraL0Compaction(earliestUnflushedSeqNum, minCompactionDepth)
+				lcf, err = sublevels.PickIntraL0Compaction(earliestUnflushedSeqNum, minCompactionDepth, opts)
 			}
 			if err != nil {
 				return fmt.Sprintf("error: %s", err.Error())
@@ -450,14 +615,338 @@ func TestL0Sublevels(t *testing.T) {
 					builder.WriteByte(',')
 				}
 			}
-			startKey := sublevels.orderedIntervals[lcf.seedInterval].startKey
 			endKey := sublevels.orderedIntervals[lcf.seedInterval+1].startKey
-			builder.WriteString(fmt.Sprintf("\nseed interval: %s-%s\n", startKey.key, endKey.key))
+			builder.WriteString(fmt.Sprintf("\nseed interval: %s-%s\n", sublevels.SeedIntervalKey(lcf), endKey.key))
+			if td.HasArg("verbose") {
+				fmt.Fprintf(&builder, "files examined: %d\n", lcf.FilesExamined())
+				smallestSeqNum, largestSeqNum := sublevels.SeqNumBounds(lcf)
+				fmt.Fprintf(&builder, "seqnums: [%d, %d]\n", smallestSeqNum, largestSeqNum)
+				fmt.Fprintf(&builder, "read amp after: %d\n", sublevels.ReadAmplificationAfter(lcf))
+				fmt.Fprintf(&builder, "shape quality: %.2f\n", sublevels.ShapeQuality(lcf))
+				fmt.Fprintf(&builder, "efficiency score: %.3g\n", sublevels.EfficiencyScore(lcf))
+			}
 			builder.WriteString(visualizeSublevels(sublevels, lcf.FilesIncluded, fileMetas[1:]))
+			if td.HasArg("blocking_files") {
+				builder.WriteString("blocking files:")
+				for _, f := range sublevels.BlockingFiles(lcf) {
+					fmt.Fprintf(&builder, " %s", f.FileNum)
+				}
+				builder.WriteString("\n")
+			}
+			if td.HasArg("trace") {
+				fmt.Fprintf(&builder, "trace:%s\n", trace.String())
+			}
+			if td.HasArg("sorted_files") {
+				builder.WriteString("sorted files:")
+				for _, f := range sublevels.SortedFiles(lcf) {
+					fmt.Fprintf(&builder, " %s", f.FileNum)
+				}
+				builder.WriteString("\n")
+			}
+			if td.HasArg("base_bytes") {
+				fmt.Fprintf(&builder, "bytes by interval from %d: %v\n",
+					lcf.minIntervalIndex, sublevels.EstimateBaseBytesByInterval(lcf))
+			}
+			if td.HasArg("sublevel_bounds") {
+				bounds := sublevels.SublevelBounds(lcf)
+				for sl := len(sublevels.levelFiles) - 1; sl >= 0; sl-- {
+					if b, ok := bounds[sl]; ok {
+						fmt.Fprintf(&builder, "0.%d: %s-%s\n", sl, b[0], b[1])
+					}
+				}
+			}
+			if td.HasArg("split_at") {
+				var splitAt int
+				td.ScanArgs(t, "split_at", &splitAt)
+				left, right, ok := sublevels.SplitCandidate(lcf, splitAt)
+				if !ok {
+					builder.WriteString("cannot split\n")
+				} else {
+					for _, half := range []*L0CompactionFiles{left, right} {
+						for i, file := range half.Files {
+							if i > 0 {
+								builder.WriteByte(',')
+							}
+							builder.WriteString(file.FileNum.String())
+						}
+						fmt.Fprintf(&builder, ", interval range: [%d, %d], seed interval %d, stack depth reduction %d\n",
+							half.minIntervalIndex, half.maxIntervalIndex, half.seedInterval,
+							half.seedIntervalStackDepthReduction)
+					}
+				}
+			}
+			if td.HasArg("mark_compacting") {
+				if err := sublevels.MarkCompacting(lcf); err != nil {
+					return fmt.Sprintf("error: %s", err.Error())
+				}
+				slice := NewLevelSliceSpecificOrder(lcf.Files)
+				sm, la := KeyRange(base.DefaultComparer.Compare, slice.Iter())
+				activeCompactions = append(activeCompactions, L0Compaction{Smallest: sm, Largest: la, IsIntraL0: lcf.isIntraL0})
+			}
 
 			return builder.String()
+		case "pick-small-file-intra-l0-compaction":
+			var maxFileSize uint64
+			var minFiles int
+			earliestUnflushedSeqNum := uint64(math.MaxUint64)
+			td.ScanArgs(t, "max_file_size", &maxFileSize)
+			td.ScanArgs(t, "min_files", &minFiles)
+			if td.HasArg("earliest_unflushed_seqnum") {
+				td.ScanArgs(t, "earliest_unflushed_seqnum", &earliestUnflushedSeqNum)
+			}
+			var limits *L0CompactionLimits
+			for _, arg := range td.CmdArgs {
+				if arg.Key == "limits" {
+					limits = parseL0CompactionLimits(t, arg)
+				}
+			}
+			lcf, err := sublevels.PickSmallFileIntraL0Compaction(
+				earliestUnflushedSeqNum, maxFileSize, minFiles, limits)
+			if err != nil {
+				return fmt.Sprintf("error: %s", err.Error())
+			}
+			if lcf == nil {
+				return "no compaction picked"
+			}
+			var builder strings.Builder
+			for i, file := range lcf.Files {
+				if i > 0 {
+					builder.WriteByte(',')
+				}
+				builder.WriteString(file.FileNum.String())
+			}
+			endKey := sublevels.orderedIntervals[lcf.seedInterval+1].startKey
+			fmt.Fprintf(&builder, "\nseed interval: %s-%s\n", sublevels.SeedIntervalKey(lcf), endKey.key)
+			builder.WriteString(visualizeSublevels(sublevels, lcf.FilesIncluded, fileMetas[1:]))
+			return builder.String()
+		case "pick-cheapest-base-compaction":
+			var minCompactionDepth, k int
+			td.ScanArgs(t, "min_depth", &minCompactionDepth)
+			td.ScanArgs(t, "k", &k)
+			baseFiles := NewLevelSliceKeySorted(base.DefaultComparer.Compare, fileMetas[baseLevel])
+			c, err := sublevels.PickCheapestBaseCompaction(minCompactionDepth, baseFiles, k)
+			if err != nil {
+				return fmt.Sprintf("error: %s", err.Error())
+			}
+			if c == nil {
+				return "no compaction picked"
+			}
+			var buf strings.Builder
+			for i, f := range c.Files {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				buf.WriteString(f.FileNum.String())
+			}
+			fmt.Fprintf(&buf, ", Lbase bytes: %d\n", sublevels.baseOverlapBytes(c, baseFiles))
+			return buf.String()
+		case "pick-compaction-to-reduce-sublevels-below":
+			var target, minCompactionDepth int
+			td.ScanArgs(t, "target", &target)
+			td.ScanArgs(t, "min_depth", &minCompactionDepth)
+			baseFiles := NewLevelSliceKeySorted(base.DefaultComparer.Compare, fileMetas[baseLevel])
+			c, err := sublevels.PickCompactionToReduceSublevelsBelow(target, minCompactionDepth, baseFiles)
+			if err != nil {
+				return fmt.Sprintf("error: %s", err.Error())
+			}
+			if c == nil {
+				return "no compaction picked"
+			}
+			var buf strings.Builder
+			for i, f := range c.Files {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				buf.WriteString(f.FileNum.String())
+			}
+			fmt.Fprintf(&buf, ", stack depth reduction: %d, bytes: %d\n", c.StackDepthReduction(), c.TotalBytes())
+			return buf.String()
+		case "pick-base-compaction-candidates":
+			var minCompactionDepth, k int
+			td.ScanArgs(t, "min_depth", &minCompactionDepth)
+			td.ScanArgs(t, "k", &k)
+			baseFiles := NewLevelSliceKeySorted(base.DefaultComparer.Compare, fileMetas[baseLevel])
+			candidates, err := sublevels.PickBaseCompactionCandidates(minCompactionDepth, baseFiles, k)
+			if err != nil {
+				return fmt.Sprintf("error: %s", err.Error())
+			}
+			if len(candidates) == 0 {
+				return "no compaction picked"
+			}
+			var buf strings.Builder
+			for i, c := range candidates {
+				fmt.Fprintf(&buf, "%d: ", i+1)
+				for j, f := range c.Files {
+					if j > 0 {
+						buf.WriteByte(',')
+					}
+					buf.WriteString(f.FileNum.String())
+				}
+				fmt.Fprintf(&buf, ", stack depth reduction: %d, bytes: %d\n", c.StackDepthReduction(), c.TotalBytes())
+				// FilesIncluded must not be shared with, or mutated by, other
+				// candidates.
+				if included := c.FilesIncluded.count(); included != len(c.Files) {
+					t.Fatalf("candidate %d includes %d files, but has %d", i+1, included, len(c.Files))
+				}
+			}
+			return buf.String()
+		case "base-compaction-candidates":
+			var minCompactionDepth int
+			td.ScanArgs(t, "min_depth", &minCompactionDepth)
+			count := math.MaxInt32
+			if td.HasArg("count") {
+				td.ScanArgs(t, "count", &count)
+			}
+			baseFiles := NewLevelSliceKeySorted(base.DefaultComparer.Compare, fileMetas[baseLevel])
+			iter := sublevels.BaseCompactionCandidates(minCompactionDepth, baseFiles, L0PickOptions{})
+			var buf strings.Builder
+			for i := 0; i < count; i++ {
+				c, err := iter.Next()
+				if err != nil {
+					return fmt.Sprintf("error: %s", err.Error())
+				}
+				if c == nil {
+					buf.WriteString("no more candidates\n")
+					break
+				}
+				fmt.Fprintf(&buf, "%d: ", i+1)
+				for j, f := range c.Files {
+					if j > 0 {
+						buf.WriteByte(',')
+					}
+					buf.WriteString(f.FileNum.String())
+				}
+				fmt.Fprintf(&buf, ", interval range: [%d, %d]\n", c.minIntervalIndex, c.maxIntervalIndex)
+			}
+			return buf.String()
+		case "build-base-compaction-for-intervals":
+			var minIntervalIndex, maxIntervalIndex int
+			td.ScanArgs(t, "intervals", &minIntervalIndex, &maxIntervalIndex)
+			baseFiles := NewLevelSliceKeySorted(base.DefaultComparer.Compare, fileMetas[baseLevel])
+			c, err := sublevels.BuildBaseCompactionForIntervals(minIntervalIndex, maxIntervalIndex, baseFiles)
+			if err != nil {
+				return fmt.Sprintf("error: %s", err.Error())
+			}
+			var builder strings.Builder
+			for i, f := range c.Files {
+				if i > 0 {
+					builder.WriteByte(',')
+				}
+				builder.WriteString(f.FileNum.String())
+			}
+			fmt.Fprintf(&builder, ", interval range: [%d, %d]\n", c.minIntervalIndex, c.maxIntervalIndex)
+			builder.WriteString(visualizeSublevels(sublevels, c.FilesIncluded, fileMetas[1:]))
+			return builder.String()
+		case "plan-compactions-to-depth":
+			var targetDepth int
+			td.ScanArgs(t, "target", &targetDepth)
+			baseFiles := NewLevelSliceKeySorted(base.DefaultComparer.Compare, fileMetas[baseLevel])
+			plan, err := sublevels.PlanCompactionsToDepth(targetDepth, baseFiles)
+			if err != nil {
+				return fmt.Sprintf("error: %s", err.Error())
+			}
+			var buf strings.Builder
+			fmt.Fprintf(&buf, "%d compactions planned\n", len(plan))
+			for i, c := range plan {
+				fmt.Fprintf(&buf, "%d: ", i+1)
+				for j, f := range c.Files {
+					if j > 0 {
+						buf.WriteByte(',')
+					}
+					buf.WriteString(f.FileNum.String())
+				}
+				fmt.Fprintf(&buf, ", interval range: [%d, %d]\n", c.minIntervalIndex, c.maxIntervalIndex)
+			}
+			return buf.String()
 		case "read-amp":
 			return strconv.Itoa(sublevels.ReadAmplification())
+		case "interval-bounds":
+			var buf strings.Builder
+			for i := -1; i <= len(sublevels.orderedIntervals); i++ {
+				start, end, ok := sublevels.IntervalBounds(i)
+				if !ok {
+					fmt.Fprintf(&buf, "%d: none\n", i)
+					continue
+				}
+				openStart, closeEnd := "[", ")"
+				if sublevels.orderedIntervals[i].startKey.isLargest {
+					openStart = "("
+				}
+				if i+1 < len(sublevels.orderedIntervals) && sublevels.orderedIntervals[i+1].startKey.isLargest {
+					closeEnd = "]"
+				}
+				fmt.Fprintf(&buf, "%d: %s%s, %s%s\n", i, openStart, start, end, closeEnd)
+			}
+			return buf.String()
+		case "read-amp-by-interval":
+			var buf strings.Builder
+			amps := sublevels.ReadAmplificationByInterval()
+			for i, key := range sublevels.IntervalBoundaryKeys() {
+				fmt.Fprintf(&buf, "%d %s: %d\n", i, sublevels.formatKey(key), amps[i])
+			}
+			return buf.String()
+		case "depth-histogram":
+			var buf strings.Builder
+			for depth, count := range sublevels.DepthHistogram() {
+				fmt.Fprintf(&buf, "%d: %d\n", depth, count)
+			}
+			return buf.String()
+		case "has-interval-deeper-than":
+			var depth int
+			td.ScanArgs(t, "depth", &depth)
+			return strconv.FormatBool(sublevels.HasIntervalDeeperThan(depth))
+		case "marshal-json":
+			data, err := sublevels.MarshalJSON()
+			if err != nil {
+				return fmt.Sprintf("error: %s", err.Error())
+			}
+			var buf bytes.Buffer
+			if err := json.Indent(&buf, data, "", "  "); err != nil {
+				t.Fatal(err)
+			}
+			return buf.String()
+		case "write-dot":
+			var buf bytes.Buffer
+			if err := sublevels.WriteDOT(&buf); err != nil {
+				return fmt.Sprintf("error: %s", err.Error())
+			}
+			return buf.String()
+		case "files-overlapping":
+			var start, end string
+			td.ScanArgs(t, "span", &start, &end)
+			files := sublevels.FilesOverlapping([]byte(start), []byte(end))
+			if len(files) == 0 {
+				return "none"
+			}
+			var buf strings.Builder
+			for _, f := range files {
+				fmt.Fprintf(&buf, "%s: sublevel %d\n", f.FileNum, f.SubLevel)
+			}
+			return buf.String()
+		case "wide-files":
+			var thresholdStr string
+			td.ScanArgs(t, "threshold", &thresholdStr)
+			threshold, err := strconv.ParseFloat(thresholdStr, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files := sublevels.WideFiles(threshold)
+			if len(files) == 0 {
+				return "none"
+			}
+			var buf strings.Builder
+			for _, f := range files {
+				fmt.Fprintf(&buf, "%s: byte fraction: %.2f\n", f.FileNum, sublevels.fileByteFraction(f))
+			}
+			return buf.String()
+		case "pending-compaction-bytes":
+			targetDepth := 1
+			if td.HasArg("target_depth") {
+				td.ScanArgs(t, "target_depth", &targetDepth)
+			}
+			return strconv.FormatUint(sublevels.PendingCompactionBytes(targetDepth), 10)
+		case "min-possible-sublevels":
+			return strconv.Itoa(sublevels.MinPossibleSublevels())
 		case "in-use-key-ranges":
 			var buf bytes.Buffer
 			for _, data := range strings.Split(strings.TrimSpace(td.Input), "\n") {
@@ -478,6 +967,37 @@ func TestL0Sublevels(t *testing.T) {
 				fmt.Fprintln(&buf)
 			}
 			return buf.String()
+		case "estimate-read-amp-increase":
+			var files []*FileMetadata
+			for _, data := range strings.Split(strings.TrimSpace(td.Input), "\n") {
+				keyRange := strings.Split(strings.TrimSpace(data), "-")
+				files = append(files, (&FileMetadata{}).ExtendPointKeyBounds(
+					base.DefaultComparer.Compare,
+					base.MakeInternalKey([]byte(strings.TrimSpace(keyRange[0])), 0, base.InternalKeyKindSet),
+					base.MakeInternalKey([]byte(strings.TrimSpace(keyRange[1])), 0, base.InternalKeyKindSet),
+				))
+			}
+			return strconv.Itoa(sublevels.EstimateReadAmpIncrease(files))
+		case "would-add-sublevel":
+			var buf bytes.Buffer
+			for _, data := range strings.Split(strings.TrimSpace(td.Input), "\n") {
+				keyRange := strings.Split(strings.TrimSpace(data), "-")
+				smallest := []byte(strings.TrimSpace(keyRange[0]))
+				largest := []byte(strings.TrimSpace(keyRange[1]))
+				fmt.Fprintf(&buf, "%s-%s: %t\n", smallest, largest,
+					sublevels.WouldAddSublevel(smallest, largest))
+			}
+			return buf.String()
+		case "shallowest-interval-in-range":
+			var buf bytes.Buffer
+			for _, data := range strings.Split(strings.TrimSpace(td.Input), "\n") {
+				keyRange := strings.Split(strings.TrimSpace(data), "-")
+				start := []byte(strings.TrimSpace(keyRange[0]))
+				end := []byte(strings.TrimSpace(keyRange[1]))
+				index, depth := sublevels.ShallowestIntervalInRange(start, end)
+				fmt.Fprintf(&buf, "%s-%s: interval %d, depth %d\n", start, end, index, depth)
+			}
+			return buf.String()
 		case "flush-split-keys":
 			var builder strings.Builder
 			builder.WriteString("flush user split keys: ")
@@ -492,6 +1012,188 @@ func TestL0Sublevels(t *testing.T) {
 				builder.WriteString("none")
 			}
 			return builder.String()
+		case "sublevel-stats":
+			var buf strings.Builder
+			stats := sublevels.SublevelStats()
+			for i := len(stats) - 1; i >= 0; i-- {
+				fmt.Fprintf(&buf, "L0.%d: files=%d bytes=%d compacting=%d\n",
+					i, stats[i].Files, stats[i].Bytes, stats[i].Compacting)
+			}
+			return buf.String()
+		case "flush-split-key-intervals":
+			var buf strings.Builder
+			for i, key := range sublevels.FlushSplitKeys() {
+				fmt.Fprintf(&buf, "%s: interval %d\n", key, sublevels.FlushSplitKeyInterval(i))
+			}
+			if buf.Len() == 0 {
+				return "none"
+			}
+			return buf.String()
+		case "flush-split-keys-with-bytes":
+			keys, splitBytes := sublevels.FlushSplitKeysWithBytes()
+			var buf strings.Builder
+			for i, key := range keys {
+				fmt.Fprintf(&buf, "%s: preceding bytes %d\n", key, splitBytes[i])
+			}
+			if buf.Len() == 0 {
+				return "none"
+			}
+			return buf.String()
+		case "files-in-sublevel":
+			var sublevel, minIntervalIndex, maxIntervalIndex int
+			td.ScanArgs(t, "sublevel", &sublevel)
+			td.ScanArgs(t, "intervals", &minIntervalIndex, &maxIntervalIndex)
+			files := sublevels.FilesInSublevelOverlappingIntervals(sublevel, minIntervalIndex, maxIntervalIndex)
+			if len(files) == 0 {
+				return "none"
+			}
+			var buf strings.Builder
+			for _, f := range files {
+				fmt.Fprintf(&buf, "%s\n", f)
+			}
+			return buf.String()
+		case "interval-boundary-keys":
+			var buf strings.Builder
+			for i, key := range sublevels.IntervalBoundaryKeys() {
+				if i > 0 {
+					buf.WriteString(", ")
+				}
+				fmt.Fprintf(&buf, "%s", sublevels.formatKey(key))
+			}
+			return buf.String()
+		case "file-intervals":
+			var buf strings.Builder
+			iter := sublevels.levelMetadata.Iter()
+			for f := iter.First(); f != nil; f = iter.Next() {
+				fmt.Fprintf(&buf, "%s: %v\n", f.FileNum, sublevels.FileIntervals(f))
+			}
+			return buf.String()
+		case "file-at-sublevel-for-key":
+			var buf strings.Builder
+			for _, line := range strings.Split(strings.TrimSpace(td.Input), "\n") {
+				fields := strings.Fields(line)
+				sublevel, err := strconv.Atoi(fields[0])
+				if err != nil {
+					return err.Error()
+				}
+				if f := sublevels.FileAtSublevelForKey(sublevel, []byte(fields[1])); f != nil {
+					fmt.Fprintf(&buf, "%s\n", f.FileNum)
+				} else {
+					buf.WriteString("none\n")
+				}
+			}
+			return buf.String()
+		case "union-interval-range":
+			var files []*FileMetadata
+			for _, field := range strings.Fields(td.Input) {
+				fileNum, err := strconv.Atoi(field)
+				if err != nil {
+					return err.Error()
+				}
+				iter := sublevels.levelMetadata.Iter()
+				for f := iter.First(); f != nil; f = iter.Next() {
+					if f.FileNum == base.FileNum(fileNum) {
+						files = append(files, f)
+					}
+				}
+			}
+			min, max := sublevels.UnionIntervalRange(files)
+			return fmt.Sprintf("[%d, %d]\n", min, max)
+		case "intervals-for-sorted-keys":
+			var keys [][]byte
+			for _, key := range strings.Fields(td.Input) {
+				keys = append(keys, []byte(key))
+			}
+			var buf strings.Builder
+			for i, index := range sublevels.IntervalsForSortedKeys(keys) {
+				fmt.Fprintf(&buf, "%s: %d\n", keys[i], index)
+			}
+			return buf.String()
+		case "clear-compacting-state":
+			sublevels.ClearCompactingState()
+			return sublevels.describe(true)
+		case "interval-compacting-counts":
+			var buf strings.Builder
+			for i, key := range sublevels.IntervalBoundaryKeys() {
+				fmt.Fprintf(&buf, "%d %s: %d of %d compacting\n", i, sublevels.formatKey(key),
+					sublevels.IntervalCompactingCount(i), len(sublevels.orderedIntervals[i].files))
+			}
+			return buf.String()
+		case "non-compacting-interval-gaps":
+			var minDepth int
+			td.ScanArgs(t, "min_depth", &minDepth)
+			gaps := sublevels.NonCompactingIntervalGaps(minDepth)
+			if len(gaps) == 0 {
+				return "none\n"
+			}
+			var buf strings.Builder
+			for _, gap := range gaps {
+				fmt.Fprintf(&buf, "[%d, %d]\n", gap[0], gap[1])
+			}
+			return buf.String()
+		case "longest-non-compacting-run":
+			start, end := sublevels.LongestNonCompactingRun()
+			return fmt.Sprintf("[%d, %d]\n", start, end)
+		case "compaction-spread-score":
+			return fmt.Sprintf("%.2f\n", sublevels.CompactionSpreadScore())
+		case "base-compacting-interval-ranges":
+			ranges := sublevels.BaseCompactingIntervalRanges()
+			if len(ranges) == 0 {
+				return "none\n"
+			}
+			var buf strings.Builder
+			for _, r := range ranges {
+				fmt.Fprintf(&buf, "[%d, %d]\n", r[0], r[1])
+			}
+			return buf.String()
+		case "min-pickable-depth":
+			return fmt.Sprintf("%d\n", sublevels.MinPickableDepth())
+		case "datadriven-string":
+			return sublevels.DataDrivenString()
+		case "is-fully-compacting":
+			return fmt.Sprintf("%t\n", sublevels.IsFullyCompacting())
+		case "occupancy-matrix":
+			var buf strings.Builder
+			m := sublevels.OccupancyMatrix()
+			for sl := len(m) - 1; sl >= 0; sl-- {
+				fmt.Fprintf(&buf, "0.%d: ", sl)
+				for _, occupied := range m[sl] {
+					if occupied {
+						buf.WriteByte('x')
+					} else {
+						buf.WriteByte('.')
+					}
+				}
+				buf.WriteByte('\n')
+			}
+			return buf.String()
+		case "cumulative-interval-bytes":
+			var buf strings.Builder
+			keys := sublevels.IntervalBoundaryKeys()
+			for i, cumulativeBytes := range sublevels.CumulativeIntervalBytes() {
+				fmt.Fprintf(&buf, "%d %s: %d\n", i, sublevels.formatKey(keys[i]), cumulativeBytes)
+			}
+			return buf.String()
+		case "files-straddling-split-keys":
+			files := sublevels.FilesStraddlingSplitKeys()
+			if len(files) == 0 {
+				return "none"
+			}
+			var buf strings.Builder
+			for _, f := range files {
+				fmt.Fprintf(&buf, "%s\n", f)
+			}
+			return buf.String()
+		case "seqnum-overlaps":
+			pairs := sublevels.SeqNumOverlaps()
+			if len(pairs) == 0 {
+				return "none"
+			}
+			var buf strings.Builder
+			for _, pair := range pairs {
+				fmt.Fprintf(&buf, "L0.%d %s, L0.%d %s\n", pair[0].SubLevel, pair[0], pair[1].SubLevel, pair[1])
+			}
+			return buf.String()
 		case "max-depth-after-ongoing-compactions":
 			return strconv.Itoa(sublevels.MaxDepthAfterOngoingCompactions())
 		case "l0-check-ordering":
@@ -613,6 +1315,8 @@ func TestAddL0FilesEquivalence(t *testing.T) {
 			s2, err = s2.AddL0Files(filesToAdd, flushSplitMaxBytes, &levelMetadata)
 			require.NoError(t, err)
 		}
+		require.NoError(t, s2.DebugCheckIndices())
+		require.NoError(t, s2.CheckInvariants())
 
 		s, err = NewL0Sublevels(&levelMetadata, testkeys.Comparer.Compare, testkeys.Comparer.FormatKey, flushSplitMaxBytes)
 		require.NoError(t, err)
@@ -621,7 +1325,854 @@ func TestAddL0FilesEquivalence(t *testing.T) {
 		require.Equal(t, s.flushSplitUserKeys, s2.flushSplitUserKeys)
 		require.Equal(t, s.orderedIntervals, s2.orderedIntervals)
 		require.Equal(t, s.levelFiles, s2.levelFiles)
+		require.True(t, s.Equal(s2))
+	}
+
+	// A difference in the estimated bytes of an interval is detected.
+	s2.orderedIntervals[0].estimatedBytes++
+	require.False(t, s.Equal(s2))
+
+	// A drifted interval range is detected.
+	fileMetas[0].maxIntervalIndex++
+	require.Error(t, s.DebugCheckIndices())
+	fileMetas[0].maxIntervalIndex--
+
+	// A file in the wrong sublevel is detected.
+	require.NoError(t, s.CheckInvariants())
+	fileMetas[0].SubLevel++
+	require.Error(t, s.CheckInvariants())
+	fileMetas[0].SubLevel--
+
+	// Overlapping files within a sublevel are detected.
+	for _, files := range s.levelFiles {
+		if len(files) > 1 {
+			files[1].minIntervalIndex = files[0].maxIntervalIndex
+			require.Error(t, s.CheckInvariants())
+			break
+		}
+	}
+}
+
+func TestRemoveL0FilesEquivalence(t *testing.T) {
+	seed := uint64(time.Now().UnixNano())
+	rng := rand.New(rand.NewSource(seed))
+	t.Logf("seed: %d", seed)
+
+	cmp := testkeys.Comparer.Compare
+	keySpace := testkeys.Alpha(2)
+	flushSplitMaxBytes := rng.Int63n(1 << 20)
+	var fileMetas []*FileMetadata
+	for i := 0; i < 200; i++ {
+		startKey := testkeys.Key(keySpace, rng.Intn(keySpace.Count()))
+		endKey := testkeys.Key(keySpace, rng.Intn(keySpace.Count()))
+		if c := bytes.Compare(startKey, endKey); c == 0 {
+			continue
+		} else if c > 0 {
+			startKey, endKey = endKey, startKey
+		}
+		largest := base.MakeInternalKey(endKey, uint64(i+1), base.InternalKeyKindSet)
+		if rng.Intn(2) == 0 {
+			largest = base.MakeRangeDeleteSentinelKey(endKey)
+		}
+		fileMetas = append(fileMetas, (&FileMetadata{
+			FileNum:        base.FileNum(i + 1),
+			Size:           rng.Uint64n(1 << 20),
+			SmallestSeqNum: uint64(i + 1),
+			LargestSeqNum:  uint64(i + 1),
+		}).ExtendPointKeyBounds(
+			cmp, base.MakeInternalKey(startKey, uint64(i+1), base.InternalKeyKindSet), largest,
+		))
+	}
+	levelMetadata := makeLevelMetadata(cmp, 0, fileMetas)
+	s2, err := NewL0Sublevels(&levelMetadata, cmp, testkeys.Comparer.FormatKey, flushSplitMaxBytes)
+	require.NoError(t, err)
+
+	for len(fileMetas) > 0 {
+		var removed, remaining []*FileMetadata
+		for _, f := range fileMetas {
+			if rng.Intn(4) == 0 {
+				removed = append(removed, f)
+			} else {
+				remaining = append(remaining, f)
+			}
+		}
+		fileMetas = remaining
+		levelMetadata := makeLevelMetadata(cmp, 0, fileMetas)
+
+		// RemoveL0Files relies on the indices in FileMetadatas pointing to that
+		// of the previous L0Sublevels, so it must be called before
+		// NewL0Sublevels.
+		s2, err = s2.RemoveL0Files(removed, flushSplitMaxBytes, &levelMetadata)
+		require.NoError(t, err)
+		require.NoError(t, s2.DebugCheckIndices())
+		require.NoError(t, s2.CheckInvariants())
+
+		s, err := NewL0Sublevels(&levelMetadata, cmp, testkeys.Comparer.FormatKey, flushSplitMaxBytes)
+		require.NoError(t, err)
+
+		// Check for equivalence.
+		require.Equal(t, s.flushSplitUserKeys, s2.flushSplitUserKeys)
+		require.Equal(t, s.orderedIntervals, s2.orderedIntervals)
+		require.Equal(t, s.levelFiles, s2.levelFiles)
+		require.True(t, s.Equal(s2))
+	}
+}
+
+func TestRemoveL0FilesErrors(t *testing.T) {
+	cmp := base.DefaultComparer.Compare
+	files := []*FileMetadata{
+		newTestFile(1, "a", "c", 1, 1<<20),
+		newTestFile(2, "b", "d", 2, 1<<20),
+		newTestFile(3, "e", "f", 3, 1<<20),
+	}
+	levelMetadata := makeLevelMetadata(cmp, 0, files)
+	s, err := NewL0Sublevels(&levelMetadata, cmp, base.DefaultFormatter, 5<<20)
+	require.NoError(t, err)
+	after := makeLevelMetadata(cmp, 0, files[1:])
+
+	// A file that isn't in the sublevels can't be removed.
+	_, err = s.RemoveL0Files([]*FileMetadata{newTestFile(4, "a", "c", 4, 1<<20)}, 5<<20, &after)
+	require.Error(t, err)
+	// A file can't be removed twice.
+	_, err = s.RemoveL0Files([]*FileMetadata{files[0], files[0]}, 5<<20, &after)
+	require.Error(t, err)
+	// The remaining files must be the ones that weren't removed.
+	_, err = s.RemoveL0Files([]*FileMetadata{files[1]}, 5<<20, &after)
+	require.Error(t, err)
+	_, err = s.RemoveL0Files(nil, 5<<20, &after)
+	require.Error(t, err)
+	// None of the above modified s.
+	require.NoError(t, s.DebugCheckIndices())
+
+	s2, err := s.RemoveL0Files(files[:1], 5<<20, &after)
+	require.NoError(t, err)
+	require.Equal(t, 1, s2.ReadAmplification())
+	require.Equal(t, 0, files[1].SubLevel)
+	require.Equal(t, 0, files[1].L0Index)
+}
+
+func TestRecomputeFlushSplitKeysInRange(t *testing.T) {
+	seed := uint64(time.Now().UnixNano())
+	rng := rand.New(rand.NewSource(seed))
+	t.Logf("seed: %d", seed)
+
+	keySpace := testkeys.Alpha(2)
+	randKey := func() []byte {
+		return testkeys.Key(keySpace, rng.Intn(keySpace.Count()))
+	}
+	var files []*FileMetadata
+	for i := 0; i < 100; i++ {
+		startKey, endKey := randKey(), randKey()
+		if c := bytes.Compare(startKey, endKey); c == 0 {
+			continue
+		} else if c > 0 {
+			startKey, endKey = endKey, startKey
+		}
+		files = append(files, (&FileMetadata{
+			FileNum:        base.FileNum(i + 1),
+			Size:           rng.Uint64n(1 << 20),
+			SmallestSeqNum: uint64(i + 1),
+			LargestSeqNum:  uint64(i + 1),
+		}).ExtendPointKeyBounds(
+			testkeys.Comparer.Compare,
+			base.MakeInternalKey(startKey, uint64(i+1), base.InternalKeyKindSet),
+			base.MakeInternalKey(endKey, uint64(i+1), base.InternalKeyKindSet),
+		))
+	}
+	levelMetadata := makeLevelMetadata(testkeys.Comparer.Compare, 0, files)
+
+	for _, opts := range []L0SublevelsOptions{
+		{},
+		{FlushSplitTargetBytes: 1 + rng.Int63n(2<<20)},
+		{FlushSplitPolicy: FlushSplitFixed},
+	} {
+		s, err := NewL0SublevelsWithOptions(&levelMetadata, testkeys.Comparer.Compare,
+			testkeys.Comparer.FormatKey, 1+rng.Int63n(64<<10), opts)
+		require.NoError(t, err)
+		for i := 0; i < 100; i++ {
+			start, end := randKey(), randKey()
+			if bytes.Compare(start, end) > 0 {
+				start, end = end, start
+			}
+			lo, hi := s.intervalRange(start, end)
+			for j := lo; j < hi; j++ {
+				s.orderedIntervals[j].estimatedBytes = rng.Uint64n(1 << 20)
+			}
+			s.RecomputeFlushSplitKeysInRange(start, end)
+
+			expected := *s
+			expected.calculateFlushSplitKeys(s.flushSplitMaxBytes)
+			require.Equal(t, expected.flushSplitUserKeys, s.flushSplitUserKeys)
+			require.Equal(t, expected.flushSplitIntervals, s.flushSplitIntervals)
+			require.Equal(t, expected.flushSplitBytes, s.flushSplitBytes)
+			require.False(t, s.FlushSplitsAreStale())
+		}
+	}
+}
+
+func TestL0SublevelsFileIntervalBytes(t *testing.T) {
+	cmp := base.DefaultComparer.Compare
+	intervalBytes := func(s *L0Sublevels) []uint64 {
+		var b []uint64
+		for i := range s.orderedIntervals {
+			b = append(b, s.orderedIntervals[i].estimatedBytes)
+		}
+		return b
+	}
+	// Attribute all of a file's bytes to its first interval.
+	opts := L0SublevelsOptions{
+		FileIntervalBytes: func(f *FileMetadata, bounds [][]byte) []uint64 {
+			require.Equal(t, f.Smallest.UserKey, bounds[0])
+			require.Equal(t, f.Largest.UserKey, bounds[len(bounds)-1])
+			b := make([]uint64, len(bounds)-1)
+			b[0] = f.Size
+			return b
+		},
+	}
+
+	files := []*FileMetadata{
+		newTestFile(1, "a", "c", 1, 90),
+		newTestFile(2, "b", "d", 2, 60),
+	}
+	lm := makeLevelMetadata(cmp, 0, files)
+	s, err := NewL0Sublevels(&lm, cmp, base.DefaultFormatter, 0)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{45, 75, 30, 0}, intervalBytes(s))
+
+	s, err = NewL0SublevelsWithOptions(&lm, cmp, base.DefaultFormatter, 0, opts)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{90, 60, 0, 0}, intervalBytes(s))
+
+	// The options are carried over by AddL0Files.
+	added := newTestFile(3, "bb", "e", 3, 30)
+	files = append(files, added)
+	lm = makeLevelMetadata(cmp, 0, files)
+	s, err = s.AddL0Files([]*FileMetadata{added}, 0, &lm)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{90, 60, 30, 0, 0, 0}, intervalBytes(s))
+
+	// An estimate with the wrong number of intervals is an error.
+	opts.FileIntervalBytes = func(f *FileMetadata, bounds [][]byte) []uint64 {
+		return []uint64{f.Size}
+	}
+	_, err = NewL0SublevelsWithOptions(&lm, cmp, base.DefaultFormatter, 0, opts)
+	require.Error(t, err)
+
+	// EstimateIntervalBytes is called once per interval. Attribute all of a
+	// file's bytes to the interval starting at its smallest key.
+	opts = L0SublevelsOptions{
+		EstimateIntervalBytes: func(f *FileMetadata, start, end []byte) uint64 {
+			require.Less(t, cmp(start, end), 0)
+			if cmp(start, f.Smallest.UserKey) == 0 {
+				return f.Size
+			}
+			return 0
+		},
+	}
+	lm = makeLevelMetadata(cmp, 0, files[:2])
+	s, err = NewL0SublevelsWithOptions(&lm, cmp, base.DefaultFormatter, 0, opts)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{90, 60, 0, 0}, intervalBytes(s))
+	lm = makeLevelMetadata(cmp, 0, files)
+	s, err = s.AddL0Files([]*FileMetadata{added}, 0, &lm)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{90, 60, 30, 0, 0, 0}, intervalBytes(s))
+
+	// FileIntervalBytes and EstimateIntervalBytes are mutually exclusive.
+	opts.FileIntervalBytes = func(f *FileMetadata, bounds [][]byte) []uint64 {
+		return make([]uint64, len(bounds)-1)
+	}
+	_, err = NewL0SublevelsWithOptions(&lm, cmp, base.DefaultFormatter, 0, opts)
+	require.Error(t, err)
+}
+
+func TestL0SublevelsArithmeticBounds(t *testing.T) {
+	cmp := base.DefaultComparer.Compare
+
+	t.Run("flush-split-max-bytes", func(t *testing.T) {
+		// Four overlapping files in four sublevels. Scaling a flushSplitMaxBytes
+		// of 1<<62+1 by the sublevel count overflows int64 and wraps around to
+		// 4, which would place a flush split key at every interval.
+		files := []*FileMetadata{
+			newTestFile(1, "a", "c", 1, 1<<20),
+			newTestFile(2, "b", "d", 2, 1<<20),
+			newTestFile(3, "c", "e", 3, 1<<20),
+			newTestFile(4, "d", "f", 4, 1<<20),
+		}
+		levelMetadata := makeLevelMetadata(cmp, 0, files)
+		s, err := NewL0Sublevels(&levelMetadata, cmp, base.DefaultFormatter, 1<<62+1)
+		require.NoError(t, err)
+		require.Equal(t, 4, len(s.Levels))
+		require.Empty(t, s.FlushSplitKeys())
+
+		s, err = NewL0Sublevels(&levelMetadata, cmp, base.DefaultFormatter, math.MaxInt64)
+		require.NoError(t, err)
+		require.Empty(t, s.FlushSplitKeys())
+	})
+
+	t.Run("many-intervals", func(t *testing.T) {
+		// Many narrow files in sublevel 0, with one wide file on top spanning
+		// all of them.
+		const n = 100000
+		files := make([]*FileMetadata, 0, n+1)
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("%08d", i)
+			files = append(files, newTestFile(base.FileNum(i+1), key, key+"a", uint64(i+1), 1<<20))
+		}
+		files = append(files, newTestFile(n+1, fmt.Sprintf("%08d", 0), fmt.Sprintf("%08d", n), n+1, 1<<30))
+		levelMetadata := makeLevelMetadata(cmp, 0, files)
+		s, err := NewL0Sublevels(&levelMetadata, cmp, base.DefaultFormatter, 1<<20)
+		require.NoError(t, err)
+		s.InitCompactingFileInfo(nil)
+		require.Equal(t, 2, len(s.Levels))
+		require.Equal(t, 2, s.ReadAmplification())
+		require.Contains(t, s.String(), fmt.Sprintf("wide file: %d", n+1))
+
+		c, err := s.PickIntraL0Compaction(math.MaxUint64, 2, L0PickOptions{})
+		require.NoError(t, err)
+		require.NotNil(t, c)
+		require.Equal(t, 2, c.seedIntervalStackDepthReduction)
+		require.Equal(t, n+1, len(c.Files))
+	})
+}
+
+func TestL0SublevelsBasePickCache(t *testing.T) {
+	cmp := base.DefaultComparer.Compare
+	// Two stacks of files, at b-c and m-n.
+	files := []*FileMetadata{
+		newTestFile(1, "b", "c", 1, 1<<20),
+		newTestFile(2, "b", "c", 2, 1<<20),
+		newTestFile(3, "b", "c", 3, 1<<20),
+		newTestFile(4, "m", "n", 4, 1<<20),
+		newTestFile(5, "m", "n", 5, 1<<20),
+	}
+	baseFiles := []*FileMetadata{newTestFile(10, "a", "e", 0, 1<<20), newTestFile(11, "k", "p", 0, 1<<20)}
+	levelMetadata := makeLevelMetadata(cmp, 0, files)
+	s, err := NewL0SublevelsWithOptions(&levelMetadata, cmp, base.DefaultFormatter, 5<<20,
+		L0SublevelsOptions{CacheBasePicks: true})
+	require.NoError(t, err)
+	s.InitCompactingFileInfo(nil)
+	baseSlice := NewLevelSliceKeySorted(cmp, baseFiles)
+	fileNums := func(c *L0CompactionFiles) []base.FileNum {
+		if c == nil {
+			return nil
+		}
+		var nums []base.FileNum
+		for _, f := range c.Files {
+			nums = append(nums, f.FileNum)
+		}
+		return nums
+	}
+
+	c, err := s.PickBaseCompaction(2, baseSlice, L0PickOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []base.FileNum{1, 2, 3}, fileNums(c))
+	// Modifying the returned candidate doesn't modify the cached one.
+	c.Files = c.Files[:1]
+
+	// Changing a file's compaction state without updating the compacting state
+	// of L0 is not noticed, since the cached result is returned.
+	files[0].CompactionState = CompactionStateCompacting
+	c, err = s.PickBaseCompaction(2, baseSlice, L0PickOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []base.FileNum{1, 2, 3}, fileNums(c))
+	files[0].CompactionState = CompactionStateNotCompacting
+
+	// Different arguments are not served from the cache.
+	c, err = s.PickBaseCompaction(4, baseSlice, L0PickOptions{})
+	require.NoError(t, err)
+	require.Nil(t, c)
+	c, err = s.PickBaseCompaction(2, baseSlice, L0PickOptions{Avoid: &UserKeyRange{Start: []byte("a"), End: []byte("d")}})
+	require.NoError(t, err)
+	require.Equal(t, []base.FileNum{4, 5}, fileNums(c))
+
+	// Updating the compacting state of L0 invalidates the cache.
+	c, err = s.PickBaseCompaction(2, baseSlice, L0PickOptions{})
+	require.NoError(t, err)
+	require.NoError(t, s.MarkCompacting(c))
+	c, err = s.PickBaseCompaction(2, baseSlice, L0PickOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []base.FileNum{4, 5}, fileNums(c))
+
+	// Lbase files that started compacting are only noticed once the
+	// compacting state is reinitialized.
+	baseFiles[1].CompactionState = CompactionStateCompacting
+	c, err = s.PickBaseCompaction(2, baseSlice, L0PickOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []base.FileNum{4, 5}, fileNums(c))
+	s.InitCompactingFileInfo(nil)
+	c, err = s.PickBaseCompaction(2, baseSlice, L0PickOptions{})
+	require.NoError(t, err)
+	require.Nil(t, c)
+
+	// So are Lbase files that stopped compacting, even if no compaction was
+	// picked.
+	baseFiles[1].CompactionState = CompactionStateNotCompacting
+	s.InitCompactingFileInfo(nil)
+	c, err = s.PickBaseCompaction(2, baseSlice, L0PickOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []base.FileNum{4, 5}, fileNums(c))
+}
+
+// TestBasePickCacheEntryMatchesAllOptions checks that every L0PickOptions
+// field is part of the PickBaseCompaction cache key, so that adding a field
+// without updating basePickCacheEntry.matches fails here.
+func TestBasePickCacheEntryMatchesAllOptions(t *testing.T) {
+	// Picks with these options set bypass the cache.
+	bypassed := map[string]bool{"OnFileAdded": true, "IntervalScorer": true}
+	// setNonZero sets v to a non-zero value, returning false if its kind isn't
+	// supported. Structs get all the fields it supports set, and pointers
+	// point to such structs, so that comparisons of the pointed-to values are
+	// checked too.
+	var setNonZero func(v reflect.Value, depth int) bool
+	setNonZero = func(v reflect.Value, depth int) bool {
+		switch v.Kind() {
+		case reflect.Bool:
+			v.SetBool(true)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			v.SetInt(1)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			v.SetUint(1)
+		case reflect.Float32, reflect.Float64:
+			v.SetFloat(1)
+		case reflect.String:
+			v.SetString("a")
+		case reflect.Slice:
+			v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+			setNonZero(v.Index(0), depth+1)
+		case reflect.Ptr:
+			v.Set(reflect.New(v.Type().Elem()))
+			if depth < 2 {
+				setNonZero(v.Elem(), depth+1)
+			}
+		case reflect.Struct:
+			for i := 0; i < v.NumField(); i++ {
+				if v.Field(i).CanSet() {
+					setNonZero(v.Field(i), depth+1)
+				}
+			}
+		default:
+			return false
+		}
+		return true
+	}
+
+	var entry basePickCacheEntry
+	require.True(t, entry.matches(0, 0, L0PickOptions{}))
+	typ := reflect.TypeOf(L0PickOptions{})
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		// Unexported fields are derived from the exported ones by the pickers.
+		if !field.IsExported() || bypassed[field.Name] {
+			continue
+		}
+		var opts L0PickOptions
+		if !setNonZero(reflect.ValueOf(&opts).Elem().Field(i), 0) {
+			t.Fatalf("unsupported type %s of L0PickOptions.%s", field.Type, field.Name)
+		}
+		require.False(t, entry.matches(0, 0, opts), "L0PickOptions.%s is not compared", field.Name)
+		require.False(t, (&basePickCacheEntry{opts: opts}).matches(0, 0, L0PickOptions{}),
+			"L0PickOptions.%s is not compared", field.Name)
+		if field.Type.Kind() == reflect.Ptr {
+			// A pointer to a zero value differs from a pointer to a non-zero one.
+			var zeroOpts L0PickOptions
+			reflect.ValueOf(&zeroOpts).Elem().Field(i).Set(reflect.New(field.Type.Elem()))
+			require.False(t, (&basePickCacheEntry{opts: zeroOpts}).matches(0, 0, opts),
+				"the value L0PickOptions.%s points to is not compared", field.Name)
+		}
+	}
+}
+
+func TestL0SublevelsSkipCompactingSeeds(t *testing.T) {
+	cmp := base.DefaultComparer.Compare
+	files := []*FileMetadata{
+		newTestFile(1, "b", "c", 1, 1<<20),
+		newTestFile(2, "b", "c", 2, 1<<20),
+		newTestFile(3, "b", "c", 3, 1<<20),
+		newTestFile(4, "m", "n", 4, 1<<20),
+		newTestFile(5, "m", "n", 5, 1<<20),
+	}
+	levelMetadata := makeLevelMetadata(cmp, 0, files)
+	s, err := NewL0Sublevels(&levelMetadata, cmp, base.DefaultFormatter, 5<<20)
+	require.NoError(t, err)
+	s.InitCompactingFileInfo(nil)
+
+	// Mark the seed file of the b-c stack as compacting, without updating the
+	// compacting state of L0.
+	files[0].CompactionState = CompactionStateCompacting
+
+	_, err = s.PickBaseCompaction(2, LevelSlice{}, L0PickOptions{})
+	require.Error(t, err)
+
+	c, err := s.PickBaseCompaction(2, LevelSlice{}, L0PickOptions{SkipCompactingSeeds: true})
+	require.NoError(t, err)
+	require.NotNil(t, c)
+	require.Equal(t, []*FileMetadata{files[3], files[4]}, c.Files)
+}
+
+func TestL0SublevelsRecomputeSubLevels(t *testing.T) {
+	cmp := base.DefaultComparer.Compare
+	files := []*FileMetadata{
+		newTestFile(1, "a", "b", 1, 1<<20),
+		newTestFile(2, "c", "d", 2, 1<<20),
+		newTestFile(3, "b", "c", 3, 1<<20),
+	}
+	levelMetadata := makeLevelMetadata(cmp, 0, files)
+	s, err := NewL0Sublevels(&levelMetadata, cmp, base.DefaultFormatter, 5<<20)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(s.Levels))
+	require.Equal(t, 1, files[2].SubLevel)
+	expected := s.String()
+
+	// Recomputing correct sublevels doesn't change anything.
+	require.NoError(t, s.RecomputeSubLevels(files))
+	require.Equal(t, expected, s.String())
+
+	// A file placed in a sublevel that is too high is moved back down, and
+	// the empty sublevels are removed. The flush split keys are stale while
+	// the file is in the wrong sublevel.
+	require.False(t, s.FlushSplitsAreStale())
+	files[2].SubLevel = 3
+	require.True(t, s.FlushSplitsAreStale())
+	require.NoError(t, s.RecomputeSubLevels(files[2:]))
+	require.False(t, s.FlushSplitsAreStale())
+	require.Equal(t, 1, files[2].SubLevel)
+	require.Equal(t, 2, len(s.Levels))
+	require.Equal(t, expected, s.String())
+
+	// A newer file placed in the sublevel of an older overlapping file is an
+	// error, unless its sublevel is recomputed too.
+	files[2].SubLevel = 0
+	require.Error(t, s.RecomputeSubLevels(files[:1]))
+	require.Equal(t, 0, files[2].SubLevel)
+	require.NoError(t, s.RecomputeSubLevels(files))
+	require.Equal(t, expected, s.String())
+}
+
+func TestL0SublevelsWeightedReadAmplification(t *testing.T) {
+	cmp := base.DefaultComparer.Compare
+	// A narrow stack of files in b-c on top of a wide file in a-y.
+	files := []*FileMetadata{
+		newTestFile(1, "a", "y", 1, 1<<20),
+		newTestFile(2, "b", "c", 2, 1<<20),
+		newTestFile(3, "b", "c", 3, 1<<20),
+		newTestFile(4, "b", "c", 4, 1<<20),
+	}
+	levelMetadata := makeLevelMetadata(cmp, 0, files)
+	s, err := NewL0Sublevels(&levelMetadata, cmp, base.DefaultFormatter, 5<<20)
+	require.NoError(t, err)
+	require.Equal(t, 4, s.ReadAmplification())
+	// The intervals [a, b), [b, c] and (c, y] are weighted equally.
+	require.Equal(t, 2.0, s.WeightedReadAmplification())
+
+	// Weighted by the distance between the first bytes of the interval
+	// bounds, the narrow stack barely contributes.
+	s, err = NewL0SublevelsWithOptions(&levelMetadata, cmp, base.DefaultFormatter, 5<<20,
+		L0SublevelsOptions{KeySpaceWidth: func(start, end []byte) float64 {
+			return float64(end[0] - start[0])
+		}})
+	require.NoError(t, err)
+	require.Equal(t, 27.0/24.0, s.WeightedReadAmplification())
+
+	levelMetadata = makeLevelMetadata(cmp, 0, nil)
+	s, err = NewL0Sublevels(&levelMetadata, cmp, base.DefaultFormatter, 5<<20)
+	require.NoError(t, err)
+	require.Equal(t, 0.0, s.WeightedReadAmplification())
+}
+
+func TestL0SublevelsSnapshot(t *testing.T) {
+	cmp := base.DefaultComparer.Compare
+	files := []*FileMetadata{
+		newTestFile(1, "a", "c", 1, 1<<20),
+		newTestFile(2, "b", "d", 2, 1<<20),
+		newTestFile(3, "b", "c", 3, 1<<20),
+		newTestFile(4, "e", "f", 4, 1<<20),
+	}
+	files[0].CompactionState = CompactionStateCompacting
+	files[1].CompactionState = CompactionStateCompacting
+	levelMetadata := makeLevelMetadata(cmp, 0, files)
+	s, err := NewL0Sublevels(&levelMetadata, cmp, base.DefaultFormatter, 5<<20)
+	require.NoError(t, err)
+	s.InitCompactingFileInfo(nil)
+	require.Equal(t, 3, s.ReadAmplification())
+	require.Equal(t, 1, s.MaxDepthAfterOngoingCompactions())
+
+	snap := s.Snapshot()
+	require.Equal(t, 3, snap.ReadAmplification())
+	require.Equal(t, 1, snap.MaxDepthAfterOngoingCompactions())
+
+	// Updates to the compacting state of s are not reflected in the snapshot.
+	s.ClearCompactingState()
+	require.Equal(t, 3, s.MaxDepthAfterOngoingCompactions())
+	require.Equal(t, 1, snap.MaxDepthAfterOngoingCompactions())
+	require.Equal(t, 3, s.Snapshot().MaxDepthAfterOngoingCompactions())
+}
+
+func TestL0SublevelsFileIntervalRange(t *testing.T) {
+	cmp := base.DefaultComparer.Compare
+	files := []*FileMetadata{
+		newTestFile(1, "a", "c", 1, 1<<20),
+		newTestFile(2, "b", "d", 2, 1<<20),
+		newTestFile(3, "e", "f", 3, 1<<20),
+	}
+	levelMetadata := makeLevelMetadata(cmp, 0, files)
+	s, err := NewL0Sublevels(&levelMetadata, cmp, base.DefaultFormatter, 5<<20)
+	require.NoError(t, err)
+	// The intervals start at a, b, c (exclusive), d (exclusive), e and f
+	// (exclusive).
+	for _, tc := range []struct {
+		f        *FileMetadata
+		min, max int
+	}{
+		{files[0], 0, 1},
+		{files[1], 1, 2},
+		{files[2], 4, 4},
+	} {
+		min, max, ok := s.FileIntervalRange(tc.f)
+		require.True(t, ok)
+		require.Equal(t, tc.min, min)
+		require.Equal(t, tc.max, max)
 	}
+
+	// A file that isn't part of the sublevels, even if it has the same bounds
+	// and cached indices as one that is, has no interval range.
+	stale := *files[2]
+	_, _, ok := s.FileIntervalRange(&stale)
+	require.False(t, ok)
+	stale.SubLevel = len(s.Levels)
+	_, _, ok = s.FileIntervalRange(&stale)
+	require.False(t, ok)
+}
+
+func TestL0SublevelsNilSeedFile(t *testing.T) {
+	cmp := base.DefaultComparer.Compare
+	// A nil seed file is reported as an error rather than a panic, whichever
+	// options the seed interval is scored with.
+	for _, opts := range []L0PickOptions{
+		{},
+		{IntervalScorer: DefaultIntervalScorer},
+		{WideSeedFileBonus: 1},
+		{MergeAdjacentSeeds: true},
+		{CreatedBefore: 1},
+		{CenteredFileRadius: 1},
+	} {
+		files := []*FileMetadata{
+			newTestFile(1, "a", "c", 1, 1<<20),
+			newTestFile(2, "b", "d", 2, 1<<20),
+		}
+		levelMetadata := makeLevelMetadata(cmp, 0, files)
+		s, err := NewL0Sublevels(&levelMetadata, cmp, base.DefaultFormatter, 5<<20)
+		require.NoError(t, err)
+		s.InitCompactingFileInfo(nil)
+		// Interval 1, [b, c], is the only one with a depth of 2.
+		require.Equal(t, 2, len(s.orderedIntervals[1].files))
+		s.orderedIntervals[1].files[0] = nil
+		_, err = s.PickBaseCompaction(2, LevelSlice{}, opts)
+		require.EqualError(t, err, "no seed file found in sublevel intervals")
+	}
+}
+
+func TestL0SublevelsInitCompactingFileInfoUnchanged(t *testing.T) {
+	cmp := base.DefaultComparer.Compare
+	files := []*FileMetadata{
+		newTestFile(1, "a", "c", 1, 1<<20),
+		newTestFile(2, "b", "d", 2, 1<<20),
+		newTestFile(3, "e", "f", 3, 1<<20),
+	}
+	levelMetadata := makeLevelMetadata(cmp, 0, files)
+	s, err := NewL0Sublevels(&levelMetadata, cmp, base.DefaultFormatter, 5<<20)
+	require.NoError(t, err)
+	baseCompactingIntervals := func() string {
+		return fmt.Sprint(s.BaseCompactingIntervalRanges())
+	}
+
+	s.InitCompactingFileInfo(nil)
+	require.Equal(t, 2, s.MaxDepthAfterOngoingCompactions())
+	// Initializing from the same state again doesn't recompute the compacting
+	// state.
+	generation := s.generation
+	s.InitCompactingFileInfo(nil)
+	require.Equal(t, generation, s.generation)
+
+	// A file that started compacting is picked up.
+	files[1].CompactionState = CompactionStateCompacting
+	s.InitCompactingFileInfo(nil)
+	require.Equal(t, 1, s.MaxDepthAfterOngoingCompactions())
+	require.Equal(t, "[[1 3]]", baseCompactingIntervals())
+
+	// So is an in-progress base compaction, and its removal.
+	inProgress := []L0Compaction{{
+		Smallest: base.MakeInternalKey([]byte("e"), 3, base.InternalKeyKindSet),
+		Largest:  base.MakeInternalKey([]byte("f"), 3, base.InternalKeyKindSet),
+	}}
+	s.InitCompactingFileInfo(inProgress)
+	require.Equal(t, "[[1 5]]", baseCompactingIntervals())
+	generation = s.generation
+	s.InitCompactingFileInfo(inProgress)
+	require.Equal(t, generation, s.generation)
+	s.InitCompactingFileInfo(nil)
+	require.Equal(t, "[[1 3]]", baseCompactingIntervals())
+
+	// The recorded bounds are copies, so bounds that change in place, in the
+	// caller's key buffers, are detected as changed.
+	s.InitCompactingFileInfo(inProgress)
+	require.Equal(t, "[[1 5]]", baseCompactingIntervals())
+	inProgress[0].Smallest.UserKey[0] = 'a'
+	s.InitCompactingFileInfo(inProgress)
+	require.Equal(t, "[[0 5]]", baseCompactingIntervals())
+	s.InitCompactingFileInfo(nil)
+	require.Equal(t, "[[1 3]]", baseCompactingIntervals())
+
+	// The order of the in-progress base compactions doesn't matter, but their
+	// number does.
+	compaction := func(smallest, largest string) L0Compaction {
+		return L0Compaction{
+			Smallest: base.MakeInternalKey([]byte(smallest), 3, base.InternalKeyKindSet),
+			Largest:  base.MakeInternalKey([]byte(largest), 3, base.InternalKeyKindSet),
+		}
+	}
+	s.InitCompactingFileInfo([]L0Compaction{compaction("e", "f"), compaction("a", "a")})
+	require.Equal(t, "[[0 5]]", baseCompactingIntervals())
+	generation = s.generation
+	s.InitCompactingFileInfo([]L0Compaction{compaction("a", "a"), compaction("e", "f")})
+	require.Equal(t, generation, s.generation)
+	s.InitCompactingFileInfo([]L0Compaction{compaction("e", "f"), compaction("e", "f")})
+	require.Equal(t, "[[1 5]]", baseCompactingIntervals())
+	s.InitCompactingFileInfo(nil)
+	require.Equal(t, "[[1 3]]", baseCompactingIntervals())
+
+	// Updates to the compacting state through other means are discarded, even
+	// if the compacting files didn't change.
+	files[0].CompactionState = CompactionStateCompacting
+	require.NoError(t, s.UpdateStateForStartedCompaction(
+		[]LevelSlice{NewLevelSliceKeySorted(cmp, files[:1])}, true /* isBase */))
+	require.Equal(t, "[[0 3]]", baseCompactingIntervals())
+	files[0].CompactionState = CompactionStateNotCompacting
+	s.InitCompactingFileInfo(nil)
+	require.Equal(t, "[[1 3]]", baseCompactingIntervals())
+
+	t.Run("lbase-compaction-finished", func(t *testing.T) {
+		// A stack of files at b-c, over an Lbase file at a-e.
+		files := []*FileMetadata{
+			newTestFile(1, "b", "c", 1, 1<<20),
+			newTestFile(2, "b", "c", 2, 1<<20),
+		}
+		levelMetadata := makeLevelMetadata(cmp, 0, files)
+		s, err := NewL0SublevelsWithOptions(&levelMetadata, cmp, base.DefaultFormatter, 5<<20,
+			L0SublevelsOptions{CacheBasePicks: true})
+		require.NoError(t, err)
+		baseFile := newTestFile(3, "a", "e", 0, 1<<20)
+		baseFiles := NewLevelSliceKeySorted(cmp, []*FileMetadata{baseFile})
+
+		// The Lbase file is compacting, so no compaction can be picked.
+		baseFile.CompactionState = CompactionStateCompacting
+		s.InitCompactingFileInfo(nil)
+		c, err := s.PickBaseCompaction(2, baseFiles, L0PickOptions{})
+		require.NoError(t, err)
+		require.Nil(t, c)
+
+		// Once the Lbase compaction finishes, reinitializing the compacting state
+		// makes the stack pickable again, even though the L0 compacting state
+		// didn't change.
+		baseFile.CompactionState = CompactionStateNotCompacting
+		s.InitCompactingFileInfo(nil)
+		c, err = s.PickBaseCompaction(2, baseFiles, L0PickOptions{})
+		require.NoError(t, err)
+		require.NotNil(t, c)
+		require.Len(t, c.Files, 2)
+	})
+}
+
+func TestL0SublevelsBaseRangesCompacting(t *testing.T) {
+	seed := uint64(time.Now().UnixNano())
+	rng := rand.New(rand.NewSource(seed))
+	t.Logf("seed: %d", seed)
+
+	cmp := testkeys.Comparer.Compare
+	keySpace := testkeys.Alpha(2)
+	randomKeys := func(n int) [][]byte {
+		keys := make([][]byte, n)
+		for i := range keys {
+			keys[i] = testkeys.Key(keySpace, rng.Intn(keySpace.Count()))
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return bytes.Compare(keys[i], keys[j]) < 0
+		})
+		return keys
+	}
+	for iter := 0; iter < 20; iter++ {
+		var l0Files []*FileMetadata
+		for i := 0; i < 50; i++ {
+			keys := randomKeys(2)
+			largest := base.MakeInternalKey(keys[1], uint64(i+1), base.InternalKeyKindSet)
+			if rng.Intn(2) == 0 && !bytes.Equal(keys[0], keys[1]) {
+				largest = base.MakeRangeDeleteSentinelKey(keys[1])
+			}
+			l0Files = append(l0Files, (&FileMetadata{
+				FileNum:        base.FileNum(i + 1),
+				Size:           1 << 20,
+				SmallestSeqNum: uint64(i + 1),
+				LargestSeqNum:  uint64(i + 1),
+			}).ExtendPointKeyBounds(
+				cmp, base.MakeInternalKey(keys[0], uint64(i+1), base.InternalKeyKindSet), largest,
+			))
+		}
+		levelMetadata := makeLevelMetadata(cmp, 0, l0Files)
+		s, err := NewL0Sublevels(&levelMetadata, cmp, testkeys.Comparer.FormatKey, 5<<20)
+		require.NoError(t, err)
+
+		// Non-overlapping Lbase files, some of which are compacting.
+		var baseFiles []*FileMetadata
+		keys := randomKeys(40)
+		for i := 0; i+1 < len(keys); i += 2 {
+			if len(baseFiles) > 0 && bytes.Equal(baseFiles[len(baseFiles)-1].Largest.UserKey, keys[i]) {
+				continue
+			}
+			f := (&FileMetadata{FileNum: base.FileNum(1000 + i), Size: 1 << 20}).ExtendPointKeyBounds(
+				cmp,
+				base.MakeInternalKey(keys[i], 0, base.InternalKeyKindSet),
+				base.MakeInternalKey(keys[i+1], 0, base.InternalKeyKindSet),
+			)
+			if rng.Intn(3) == 0 {
+				f.CompactionState = CompactionStateCompacting
+			}
+			baseFiles = append(baseFiles, f)
+		}
+		baseSlice := NewLevelSliceKeySorted(cmp, baseFiles)
+		ranges := collectCompactingBaseRanges(baseSlice)
+		for min := 0; min < len(s.orderedIntervals)-1; min++ {
+			for max := min; max < len(s.orderedIntervals)-1; max++ {
+				require.Equal(t,
+					s.baseFilesCompacting(min, max, baseSlice),
+					s.baseRangesCompacting(min, max, ranges),
+					"intervals [%d, %d]", min, max)
+			}
+		}
+	}
+}
+
+func TestL0SublevelsRangeKeyBounds(t *testing.T) {
+	cmp := base.DefaultComparer.Compare
+	// File 1 has point keys in a-b, and range keys in a-e. File 2 has point
+	// keys in d-f. The files only overlap through the range keys of file 1.
+	f1 := (&FileMetadata{FileNum: 1, Size: 1 << 20, SmallestSeqNum: 1, LargestSeqNum: 1}).
+		ExtendPointKeyBounds(cmp,
+			base.MakeInternalKey([]byte("a"), 1, base.InternalKeyKindSet),
+			base.MakeInternalKey([]byte("b"), 1, base.InternalKeyKindSet)).
+		ExtendRangeKeyBounds(cmp,
+			base.MakeInternalKey([]byte("a"), 1, base.InternalKeyKindRangeKeySet),
+			base.MakeExclusiveSentinelKey(base.InternalKeyKindRangeKeySet, []byte("e")))
+	f2 := (&FileMetadata{FileNum: 2, Size: 1 << 20, SmallestSeqNum: 2, LargestSeqNum: 2}).
+		ExtendPointKeyBounds(cmp,
+			base.MakeInternalKey([]byte("d"), 2, base.InternalKeyKindSet),
+			base.MakeInternalKey([]byte("f"), 2, base.InternalKeyKindSet))
+	levelMetadata := makeLevelMetadata(cmp, 0, []*FileMetadata{f1, f2})
+	s, err := NewL0Sublevels(&levelMetadata, cmp, base.DefaultFormatter, 5<<20)
+	require.NoError(t, err)
+	require.Equal(t, 0, f1.SubLevel)
+	require.Equal(t, 1, f2.SubLevel)
+	require.Equal(t, 2, s.ReadAmplification())
+	require.Equal(t, []*FileMetadata{f1, f2}, s.FilesOverlapping([]byte("d"), []byte("e")))
 }
 
 func BenchmarkManifestApplyWithL0Sublevels(b *testing.B) {
@@ -662,10 +2213,139 @@ func BenchmarkL0SublevelsInitAndPick(b *testing.B) {
 		if sl == nil {
 			b.Fatal("expected non-nil L0Sublevels to be generated")
 		}
-		c, err := sl.PickBaseCompaction(2, LevelSlice{})
+		c, err := sl.PickBaseCompaction(2, LevelSlice{}, L0PickOptions{})
 		require.NoError(b, err)
 		if c == nil {
 			b.Fatal("expected non-nil compaction to be generated")
 		}
 	}
 }
+
+func BenchmarkL0SublevelsInitCompactingFileInfo(b *testing.B) {
+	v, err := readManifest("testdata/MANIFEST_import")
+	if err != nil {
+		b.Fatal(err)
+	}
+	sl, err := NewL0Sublevels(&v.Levels[0],
+		base.DefaultComparer.Compare, base.DefaultFormatter, 5<<20)
+	require.NoError(b, err)
+	// 100 in-progress base compactions, each compacting a single L0 file,
+	// spread across L0.
+	const compactions = 100
+	var inProgress []L0Compaction
+	var compacting []*FileMetadata
+	step := v.Levels[0].Len() / compactions
+	iter := v.Levels[0].Iter()
+	for i, f := 0, iter.First(); f != nil && len(inProgress) < compactions; i, f = i+1, iter.Next() {
+		if i%step != 0 {
+			continue
+		}
+		f.CompactionState = CompactionStateCompacting
+		compacting = append(compacting, f)
+		inProgress = append(inProgress, L0Compaction{Smallest: f.Smallest, Largest: f.Largest})
+	}
+	defer func() {
+		for _, f := range compacting {
+			f.CompactionState = CompactionStateNotCompacting
+		}
+	}()
+	b.Run("unchanged", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			sl.InitCompactingFileInfo(inProgress)
+		}
+	})
+	b.Run("changed", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			// Alternate between all compactions and all but the last, so the
+			// compacting state is recomputed on every call.
+			sl.InitCompactingFileInfo(inProgress[:len(inProgress)-n%2])
+		}
+	})
+}
+
+func BenchmarkL0SublevelsPick(b *testing.B) {
+	v, err := readManifest("testdata/MANIFEST_import")
+	if err != nil {
+		b.Fatal(err)
+	}
+	sl, err := NewL0Sublevels(&v.Levels[0],
+		base.DefaultComparer.Compare, base.DefaultFormatter, 5<<20)
+	require.NoError(b, err)
+	// A compacting Lbase file spanning all of L0, so that every candidate
+	// built from a seed interval is rejected.
+	cmp := base.DefaultComparer.Compare
+	baseFile := (&FileMetadata{FileNum: 1 << 30, Size: 1 << 20}).ExtendPointKeyBounds(cmp,
+		base.MakeInternalKey(nil, 0, base.InternalKeyKindSet),
+		base.MakeInternalKey(bytes.Repeat([]byte{0xff}, 16), 0, base.InternalKeyKindSet))
+	baseFile.CompactionState = CompactionStateCompacting
+	baseFiles := NewLevelSliceKeySorted(cmp, []*FileMetadata{baseFile})
+	b.Run("base", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			c, err := sl.PickBaseCompaction(2, baseFiles, L0PickOptions{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			if c != nil {
+				b.Fatal("expected no compaction to be picked")
+			}
+		}
+	})
+	b.Run("intra-l0", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			if _, err := sl.PickIntraL0Compaction(math.MaxUint64, 2, L0PickOptions{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkL0SublevelsPickLargeLbase(b *testing.B) {
+	// 1000 disjoint stacks of three L0 files, each sitting on top of 100 Lbase
+	// files, the last of which is compacting. Every candidate is rejected, but
+	// only after scanning the Lbase files it overlaps.
+	cmp := base.DefaultComparer.Compare
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%08d", i)) }
+	const stacks = 1000
+	var l0Files, baseFiles []*FileMetadata
+	for i := 0; i < stacks; i++ {
+		for j := 0; j < 3; j++ {
+			seqNum := uint64(j*stacks + i + 1)
+			l0Files = append(l0Files, (&FileMetadata{
+				FileNum:        base.FileNum(seqNum),
+				Size:           1 << 20,
+				SmallestSeqNum: seqNum,
+				LargestSeqNum:  seqNum,
+			}).ExtendPointKeyBounds(cmp,
+				base.MakeInternalKey(key(i*100), seqNum, base.InternalKeyKindSet),
+				base.MakeInternalKey(key(i*100+99), seqNum, base.InternalKeyKindSet)))
+		}
+		for j := 0; j < 100; j++ {
+			f := (&FileMetadata{FileNum: base.FileNum(1<<20 + i*100 + j), Size: 1 << 20}).ExtendPointKeyBounds(cmp,
+				base.MakeInternalKey(key(i*100+j), 0, base.InternalKeyKindSet),
+				base.MakeInternalKey(key(i*100+j), 0, base.InternalKeyKindSet))
+			if j == 99 {
+				f.CompactionState = CompactionStateCompacting
+			}
+			baseFiles = append(baseFiles, f)
+		}
+	}
+	levelMetadata := makeLevelMetadata(cmp, 0, l0Files)
+	sl, err := NewL0Sublevels(&levelMetadata, cmp, base.DefaultFormatter, 5<<20)
+	require.NoError(b, err)
+	baseLevel := NewLevelSliceKeySorted(cmp, baseFiles)
+	b.ResetTimer()
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		c, err := sl.PickBaseCompaction(2, baseLevel, L0PickOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if c != nil {
+			b.Fatal("expected no compaction to be picked")
+		}
+	}
+}